@@ -0,0 +1,44 @@
+package code
+
+import "sync"
+
+const subscriberBuffer = 64
+
+// broker fans values out to subscribers without blocking the publisher.
+// Slow subscribers miss values, so it must only be used for notifications
+// whose authoritative state can be fetched again.
+type broker[T any] struct {
+	mu          sync.Mutex
+	subscribers map[chan T]struct{}
+}
+
+func newBroker[T any]() *broker[T] {
+	return &broker[T]{
+		subscribers: make(map[chan T]struct{}),
+	}
+}
+
+func (b *broker[T]) Subscribe() (<-chan T, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan T, subscriberBuffer)
+	b.subscribers[ch] = struct{}{}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, ch)
+	}
+}
+
+func (b *broker[T]) Publish(value T) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- value:
+		default:
+		}
+	}
+}
@@ -46,5 +46,6 @@ func (c *Code) ClipDeleteHandler(w http.ResponseWriter, req *http.Request) {
 		http.NotFound(w, req)
 		return
 	}
+	c.events.Emit(ClipRemoved, id)
 	w.WriteHeader(http.StatusOK)
 }
@@ -1,33 +1,73 @@
 package code
 
 import (
+	"errors"
 	"io/fs"
+	"log"
+	"os"
 	"time"
 
 	"github.com/hvaghani221/autopyter/internal/clip"
+	"github.com/hvaghani221/autopyter/internal/kernel"
 )
 
+type Options struct {
+	Debug   bool
+	Timeout time.Duration
+	Pool    kernel.PoolConfig
+	// KernelSpec is the kernelspec used until another one is picked.
+	KernelSpec string
+	// Compare lists the targets "Execute on all" runs on, every kernelspec
+	// of the default server when empty.
+	Compare []kernel.Target
+	// Store persists the session named Session, nothing is persisted
+	// when it is nil. Resume reloads the session from Store on startup.
+	Store   Store
+	Session string
+	Resume  bool
+}
+
 type Code struct {
 	clipStream chan string
 	cancelFunc func()
 	history    *History
 	state      *State
+	events     *EventBus
+	store      Store
+	session    string
+	closeChan  chan struct{}
+	compare    []kernel.Target
 	fs         fs.FS
 	debug      bool
 }
 
-func NewCode(fs fs.FS, debug ...bool) *Code {
+func NewCode(fs fs.FS, options Options) *Code {
 	clipStream, cancleFunc := clip.NewStream(time.Millisecond * 100)
+	events := NewEventBus()
 	code := &Code{
 		clipStream: clipStream,
 		cancelFunc: cancleFunc,
 		history:    NewHistory(),
 		fs:         fs,
-		state:      NewState(),
+		state:      NewState(options, events),
+		events:     events,
+		store:      options.Store,
+		session:    options.Session,
+		closeChan:  make(chan struct{}),
+		compare:    options.Compare,
+		debug:      options.Debug,
 	}
 
-	if len(debug) > 0 {
-		code.debug = debug[0]
+	if code.store != nil {
+		if options.Resume {
+			if err := code.restore(); err != nil {
+				log.Fatal("resuming session ", code.session, ": ", err)
+			}
+		} else if _, err := code.store.Load(code.session); !errors.Is(err, os.ErrNotExist) {
+			// persisting would overwrite the saved session
+			log.Fatal("session ", code.session, " already exists, use -resume to continue it or pick another name")
+		}
+		go code.persist()
 	}
 
 	go code.listenStream()
@@ -36,11 +76,14 @@ func NewCode(fs fs.FS, debug ...bool) *Code {
 
 func (c *Code) listenStream() {
 	for data := range c.clipStream {
-		c.history.Add(data)
+		id := c.history.Add(data)
+		c.events.Emit(ClipAdded, id)
 	}
 }
 
 func (c *Code) Close() {
 	c.cancelFunc()
+	close(c.closeChan)
+	c.save()
 	c.state.Close()
 }
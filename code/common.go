@@ -1,9 +1,11 @@
 package code
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -56,3 +58,30 @@ func filterList[T withID](w http.ResponseWriter, r *http.Request, list []T) ([]T
 
 	return list, lastID, true
 }
+
+func startSSE(w http.ResponseWriter) (http.Flusher, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+	return flusher, true
+}
+
+func writeSSE(w http.ResponseWriter, flusher http.Flusher, event, data string) error {
+	builder := strings.Builder{}
+	builder.WriteString("event: " + event + "\n")
+	for _, line := range strings.Split(data, "\n") {
+		builder.WriteString("data: " + line + "\n")
+	}
+	builder.WriteString("\n")
+	if _, err := fmt.Fprint(w, builder.String()); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
@@ -0,0 +1,121 @@
+package code
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/hvaghani221/autopyter/internal/kernel"
+)
+
+type comparison struct {
+	State *ExecutionState
+	Text  string
+	Diff  []DiffLine
+}
+
+func (c *Code) ExecuteAllHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseID(w, r)
+	if !ok {
+		return
+	}
+
+	code, ok := c.history.Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	targets, err := c.compareTargets()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := c.state.ExecuteAll(code.Code, targets); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.history.Remove(id)
+	c.events.Emit(ClipRemoved, id)
+}
+
+// compareTargets returns the configured comparison targets, or every
+// kernelspec of the default server when none are configured.
+func (c *Code) compareTargets() ([]kernel.Target, error) {
+	if len(c.compare) > 0 {
+		return c.compare, nil
+	}
+
+	specs, _, err := kernel.ListKernelSpecs()
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]kernel.Target, 0, len(specs))
+	for _, spec := range specs {
+		targets = append(targets, kernel.Target{Server: kernel.DefaultServer(), Spec: spec.Name})
+	}
+	return targets, nil
+}
+
+func (c *Code) CompareHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseID(w, r)
+	if !ok {
+		return
+	}
+
+	states := c.state.Group(id)
+	if len(states) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	comparisons := make([]comparison, 0, len(states))
+	for _, state := range states {
+		state.WaitForResult()
+		comparisons = append(comparisons, comparison{
+			State: state,
+			Text:  state.outputText(),
+		})
+	}
+
+	base := strings.Split(comparisons[0].Text, "\n")
+	for i := range comparisons[1:] {
+		comparisons[i+1].Diff = diffLines(base, strings.Split(comparisons[i+1].Text, "\n"))
+	}
+
+	tmpl := template.Must(template.New("compare").ParseFS(c.fs, "templates/compare.html"))
+	if err := tmpl.ExecuteTemplate(w, "compare.html", comparisons); err != nil {
+		log.Println(err)
+	}
+}
+
+// outputText joins the text outputs of the state, it is what executions on
+// different targets are compared by.
+func (es *ExecutionState) outputText() string {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	builder := strings.Builder{}
+	for _, result := range es.Results {
+		if result.Stream != nil {
+			builder.WriteString(result.Stream.Text)
+			continue
+		}
+		if text, ok := result.Data["text/plain"]; ok {
+			builder.WriteString(fmt.Sprint(text))
+			builder.WriteString("\n")
+		}
+	}
+	for _, exception := range es.Exceptions {
+		builder.WriteString(exception.EName + ": " + exception.EValue + "\n")
+	}
+	if es.Error != nil {
+		builder.WriteString("Error: " + es.Error.Error() + "\n")
+	}
+	return strings.TrimRight(builder.String(), "\n")
+}
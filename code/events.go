@@ -0,0 +1,61 @@
+package code
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type EventType string
+
+const (
+	ClipAdded         EventType = "clipAdded"
+	ClipRemoved       EventType = "clipRemoved"
+	ExecutionStarted  EventType = "executionStarted"
+	ExecutionFinished EventType = "executionFinished"
+	ExecutionRemoved  EventType = "executionRemoved"
+	StateSelected     EventType = "stateSelected"
+	StateReset        EventType = "stateReset"
+	HeadChanged       EventType = "headChanged"
+	ReplayChanged     EventType = "replayChanged"
+	KernelSpecChanged EventType = "kernelSpecChanged"
+)
+
+type Event struct {
+	Type EventType
+	ID   int64
+}
+
+type EventBus struct {
+	*broker[Event]
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{broker: newBroker[Event]()}
+}
+
+func (b *EventBus) Emit(eventType EventType, id int64) {
+	b.Publish(Event{Type: eventType, ID: id})
+}
+
+func (c *Code) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := startSSE(w)
+	if !ok {
+		return
+	}
+
+	events, cancel := c.events.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if err := writeSSE(w, flusher, string(event.Type), strconv.FormatInt(event.ID, 10)); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"net/http"
 	"strings"
+
+	"github.com/hvaghani221/autopyter/internal/kernel"
 )
 
 func (c *Code) CodeHandler(w http.ResponseWriter, r *http.Request) {
@@ -55,13 +57,44 @@ func (c *Code) ExecuteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	c.history.Remove(id)
 	if err := c.state.Execute(code.Code); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("HX-Trigger", "codeExecuted")
+	c.history.Remove(id)
+	c.events.Emit(ClipRemoved, id)
+}
+
+func (c *Code) CancelHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := c.state.Cancel(id); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (c *Code) InputHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseID(w, r)
+	if !ok {
+		return
+	}
+
+	state := c.state.GetState(id)
+	if state == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if err := state.SendInput(r.FormValue("value")); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 }
 
 func (c *Code) ResultHandler(w http.ResponseWriter, r *http.Request) {
@@ -79,10 +112,106 @@ func (c *Code) ResultHandler(w http.ResponseWriter, r *http.Request) {
 
 	if state.Error != nil {
 		log.Println(state.Error)
-		http.Error(w, state.Error.Error(), http.StatusInternalServerError)
+	}
+
+	tmpl := c.resultTemplate()
+	if err := tmpl.ExecuteTemplate(w, "result.html", state); err != nil {
+		log.Println(err)
+	}
+}
+
+type inputView struct {
+	ID int64
+	*kernel.InputPrompt
+}
+
+func (c *Code) ResultStreamHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseID(w, r)
+	if !ok {
+		return
+	}
+
+	state := c.state.GetState(id)
+	if state == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	flusher, ok := startSSE(w)
+	if !ok {
 		return
 	}
 
+	results, exceptions, events, cancel := state.Subscribe()
+	defer cancel()
+
+	tmpl := c.resultTemplate()
+	send := func(event kernel.Event) error {
+		builder := strings.Builder{}
+		var err error
+		switch {
+		case event.Input != nil:
+			err = tmpl.ExecuteTemplate(&builder, "input", inputView{ID: id, InputPrompt: event.Input})
+			if err == nil {
+				err = writeSSE(w, flusher, "input", builder.String())
+			}
+			return err
+		case event.Exception != nil:
+			err = tmpl.ExecuteTemplate(&builder, "exception", event.Exception)
+		default:
+			err = tmpl.ExecuteTemplate(&builder, "result", event.Result)
+		}
+		if err != nil {
+			return err
+		}
+		return writeSSE(w, flusher, "output", builder.String())
+	}
+
+	// reset replaces the outputs rendered so far, e.g. after clear_output
+	reset := func(event outputEvent) error {
+		builder := strings.Builder{}
+		if err := tmpl.ExecuteTemplate(&builder, "liveoutputs", event); err != nil {
+			return err
+		}
+		return writeSSE(w, flusher, "outputs", builder.String())
+	}
+
+	if err := reset(outputEvent{Results: results, Exceptions: exceptions}); err != nil {
+		log.Println(err)
+		return
+	}
+	if prompt := state.PendingInput(); prompt != nil {
+		if err := send(kernel.Event{Input: prompt}); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			var err error
+			if event.Reset {
+				err = reset(event)
+			} else {
+				err = send(event.Event)
+			}
+			if err != nil {
+				log.Println(err)
+				return
+			}
+		case <-state.Done():
+			if err := writeSSE(w, flusher, "done", ""); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+	}
+}
+
+func (c *Code) resultTemplate() *template.Template {
 	funcs := template.FuncMap{
 		"gethtml": func(mimetype string, value any) template.HTML {
 			if strings.HasPrefix(mimetype, "text/") {
@@ -98,42 +227,46 @@ func (c *Code) ResultHandler(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	tmpl := template.Must(template.New("result").Funcs(funcs).ParseFS(c.fs, "templates/result.html"))
-	if err := tmpl.ExecuteTemplate(w, "result.html", state); err != nil {
-		log.Println(err)
-	}
+	return template.Must(template.New("result").Funcs(funcs).ParseFS(c.fs, "templates/result.html"))
 }
 
 func (c *Code) StateHander(w http.ResponseWriter, r *http.Request) {
-	list, lastID, ok := filterList(w, r, c.state.ListStates(false))
-	if !ok {
-		return
-	}
-
 	data := struct {
-		States []*ExecutionState
-		LastID int64
+		Checkpoints []CheckpointView
+		ReplayState *ExecutionState
+		ReplayError error
+		Broken      bool
+		AllowBroken bool
 	}{
-		States: list,
-		LastID: lastID,
+		Checkpoints: c.state.Tree(),
+		AllowBroken: c.state.AllowBroken(),
 	}
-
-	funcs := template.FuncMap{
-		"add": func(a, b int) int {
-			return a + b
-		},
+	if state, replayErr := c.state.ReplayFailure(); replayErr != nil {
+		data.ReplayState = state
+		data.ReplayError = replayErr
+		data.Broken = replayErr.Exception != nil
 	}
 
-	if len(data.States) > 0 {
+	if len(data.Checkpoints) > 0 {
 		w.Header().Set("HX-Trigger", "stateUpdated")
 	}
 
-	tmpl := template.Must(template.New("state").Funcs(funcs).ParseFS(c.fs, "templates/state.html"))
+	tmpl := template.Must(template.New("state").ParseFS(c.fs, "templates/state.html"))
 	if err := tmpl.ExecuteTemplate(w, "state.html", data); err != nil {
 		log.Println(err)
 	}
 }
 
+func (c *Code) AllowBrokenHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		log.Println("Error parsing allow broken request form", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c.state.SetAllowBroken(r.Form.Get("allow") == "true")
+}
+
 func (c *Code) StateDeleteHander(w http.ResponseWriter, r *http.Request) {
 	id, ok := parseID(w, r)
 	if !ok {
@@ -146,15 +279,11 @@ func (c *Code) StateDeleteHander(w http.ResponseWriter, r *http.Request) {
 	}
 
 	c.state.ResetState(true)
-	w.Header().Set("HX-Trigger", "stateReset")
-	w.Header().Set("HX-Refresh", "true")
 }
 
 func (c *Code) StateResetHander(w http.ResponseWriter, r *http.Request) {
-	c.state.ResetState(false)
 	c.history.Clear()
-	w.Header().Set("HX-Trigger", "stateReset")
-	w.Header().Set("HX-Refresh", "true")
+	c.state.ResetState(false)
 }
 
 func (c *Code) SelectHandler(w http.ResponseWriter, r *http.Request) {
@@ -168,10 +297,19 @@ func (c *Code) SelectHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+}
+
+func (c *Code) CheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseID(w, r)
+	if !ok {
+		return
+	}
 
-	w.Header().Set("HX-Trigger", "stateSelected")
-	// TODO: fix with custom events
-	w.Header().Set("HX-Refresh", "true")
+	if err := c.state.Checkout(id); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 }
 
 func (c *Code) EditorHandler(w http.ResponseWriter, r *http.Request) {
@@ -194,7 +332,6 @@ func (c *Code) EditorExecuteHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("HX-Trigger", "codeExecuted")
 	tmpl := template.Must(template.New("editor").ParseFS(c.fs, "templates/editor.html"))
 	if err := tmpl.ExecuteTemplate(w, "editor.html", nil); err != nil {
 		log.Println(err)
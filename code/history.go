@@ -26,14 +26,16 @@ func NewHistory() *History {
 	}
 }
 
-func (h *History) Add(item string) {
+func (h *History) Add(item string) int64 {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	id := h.lastID
 	h.Items = append(h.Items, HistoryItem{
 		Code: item,
-		ID:   h.lastID,
+		ID:   id,
 	})
 	h.lastID++
+	return id
 }
 
 func (h *History) Get(id int64) (HistoryItem, bool) {
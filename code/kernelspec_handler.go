@@ -0,0 +1,50 @@
+package code
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/hvaghani221/autopyter/internal/kernel"
+)
+
+func (c *Code) KernelSpecHandler(w http.ResponseWriter, r *http.Request) {
+	specs, _, err := kernel.ListKernelSpecs()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Specs   []kernel.KernelSpec
+		Current string
+	}{
+		Specs:   specs,
+		Current: c.state.KernelSpec(),
+	}
+
+	tmpl := template.Must(template.New("kernelspec").ParseFS(c.fs, "templates/kernelspec.html"))
+	if err := tmpl.ExecuteTemplate(w, "kernelspec.html", data); err != nil {
+		log.Println(err)
+	}
+}
+
+func (c *Code) KernelSpecSelectHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		log.Println("Error parsing kernelspec request form", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	spec := r.Form.Get("spec")
+	if spec == "" {
+		http.Error(w, "missing kernelspec", http.StatusBadRequest)
+		return
+	}
+	if err := c.state.SetKernelSpec(spec); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
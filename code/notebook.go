@@ -0,0 +1,259 @@
+package code
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hvaghani221/autopyter/internal/kernel"
+)
+
+type Notebook struct {
+	Cells         []NotebookCell `json:"cells"`
+	Metadata      map[string]any `json:"metadata"`
+	NBFormat      int            `json:"nbformat"`
+	NBFormatMinor int            `json:"nbformat_minor"`
+}
+
+type NotebookCell struct {
+	CellType       string           `json:"cell_type"`
+	ExecutionCount *int             `json:"execution_count"`
+	Metadata       map[string]any   `json:"metadata"`
+	Outputs        []map[string]any `json:"outputs"`
+	Source         []string         `json:"source"`
+}
+
+// importedNotebook only decodes what is needed to import code cells,
+// source is either a string or a list of strings in nbformat v4.
+type importedNotebook struct {
+	Cells []struct {
+		CellType string          `json:"cell_type"`
+		Source   json.RawMessage `json:"source"`
+	} `json:"cells"`
+	NBFormat int `json:"nbformat"`
+}
+
+func (c *Code) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		log.Println("reading imported file", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := c.importContent(header.Filename, content); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+}
+
+func (c *Code) Import(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return c.importContent(path, content)
+}
+
+func (c *Code) importContent(name string, content []byte) error {
+	var cells []string
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".ipynb":
+		var err error
+		if cells, err = parseNotebook(content); err != nil {
+			return err
+		}
+	case ".py":
+		cells = parseScript(string(content))
+	default:
+		return fmt.Errorf("unsupported file type: %s", name)
+	}
+	return c.state.Import(cells)
+}
+
+func parseNotebook(content []byte) ([]string, error) {
+	var notebook importedNotebook
+	if err := json.Unmarshal(content, &notebook); err != nil {
+		return nil, err
+	}
+	if notebook.NBFormat != 4 {
+		return nil, fmt.Errorf("unsupported nbformat version: %d", notebook.NBFormat)
+	}
+
+	cells := make([]string, 0, len(notebook.Cells))
+	for _, cell := range notebook.Cells {
+		if cell.CellType != "code" {
+			continue
+		}
+		var source string
+		if err := json.Unmarshal(cell.Source, &source); err != nil {
+			var lines []string
+			if err := json.Unmarshal(cell.Source, &lines); err != nil {
+				return nil, errors.New("invalid cell source")
+			}
+			source = strings.Join(lines, "")
+		}
+		if strings.TrimSpace(source) == "" {
+			continue
+		}
+		cells = append(cells, source)
+	}
+	return cells, nil
+}
+
+func (c *Code) ExportNotebookHandler(w http.ResponseWriter, r *http.Request) {
+	states := c.state.PreviousStates()
+	notebook := newNotebook(states, c.exportSpec(states))
+
+	w.Header().Set("Content-Type", "application/x-ipynb+json")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+c.exportName()+`.ipynb"`)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", " ")
+	if err := encoder.Encode(notebook); err != nil {
+		log.Println(err)
+	}
+}
+
+// exportSpec returns the kernelspec the last exported cell ran on, falling
+// back to the current one for sessions saved without it.
+func (c *Code) exportSpec(states []*ExecutionState) kernel.KernelSpec {
+	target := kernel.Target{Server: kernel.DefaultServer(), Spec: c.state.KernelSpec()}
+	if len(states) > 0 && states[len(states)-1].KernelSpec != "" {
+		last := states[len(states)-1]
+		target.Spec = last.KernelSpec
+		if parsed, err := kernel.ParseTarget(last.Target); err == nil {
+			target = parsed
+		}
+	}
+
+	spec := kernel.KernelSpec{Name: target.Spec}
+	if target.Server == nil {
+		return spec
+	}
+	specs, _, err := target.Server.ListKernelSpecs()
+	if err != nil {
+		log.Println(err)
+		return spec
+	}
+	for _, candidate := range specs {
+		if candidate.Name == spec.Name {
+			spec = candidate
+		}
+	}
+	return spec
+}
+
+func (c *Code) exportName() string {
+	if c.session != "" {
+		return c.session
+	}
+	return "autopyter"
+}
+
+func newNotebook(states []*ExecutionState, spec kernel.KernelSpec) *Notebook {
+	if spec.DisplayName == "" {
+		spec.DisplayName = spec.Name
+	}
+	notebook := &Notebook{
+		Cells: make([]NotebookCell, 0, len(states)),
+		Metadata: map[string]any{
+			"kernelspec": map[string]any{
+				"name":         spec.Name,
+				"display_name": spec.DisplayName,
+				"language":     spec.Language,
+			},
+			"language_info": map[string]any{
+				"name": spec.Language,
+			},
+		},
+		NBFormat:      4,
+		NBFormatMinor: 4,
+	}
+
+	for i, state := range states {
+		count := i + 1
+		notebook.Cells = append(notebook.Cells, NotebookCell{
+			CellType:       "code",
+			ExecutionCount: &count,
+			Metadata:       map[string]any{},
+			Outputs:        state.notebookOutputs(count),
+			Source:         splitLines(state.Code),
+		})
+	}
+	return notebook
+}
+
+func (es *ExecutionState) notebookOutputs(count int) []map[string]any {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	outputs := make([]map[string]any, 0, len(es.Results)+len(es.Exceptions))
+	for _, result := range es.Results {
+		outputs = append(outputs, notebookOutput(result, count))
+	}
+	for _, exception := range es.Exceptions {
+		// imported states and sessions saved before RawTraceback have none
+		traceback := exception.RawTraceback
+		if traceback == nil {
+			traceback = []string{}
+		}
+		outputs = append(outputs, map[string]any{
+			"output_type": "error",
+			"ename":       exception.EName,
+			"evalue":      exception.EValue,
+			"traceback":   traceback,
+		})
+	}
+	return outputs
+}
+
+func notebookOutput(result kernel.ResultMessage, count int) map[string]any {
+	if result.Stream != nil {
+		return map[string]any{
+			"output_type": "stream",
+			"name":        result.Stream.Name,
+			"text":        splitLines(result.Stream.Text),
+		}
+	}
+
+	metadata := result.MetaData
+	if metadata == nil {
+		metadata = map[string]any{}
+	}
+	output := map[string]any{
+		"output_type": string(kernel.DisplayData),
+		"data":        result.Data,
+		"metadata":    metadata,
+	}
+	if result.Type == kernel.ExecuteResult {
+		output["output_type"] = string(kernel.ExecuteResult)
+		output["execution_count"] = count
+	}
+	return output
+}
+
+// splitLines splits text into lines keeping the line endings, the way
+// nbformat stores multiline strings.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
@@ -0,0 +1,76 @@
+package code
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const cellMarker = "# %%"
+
+// parseScript splits a python script into cells delimited by "# %%" lines.
+func parseScript(content string) []string {
+	var cells []string
+	current := []string{}
+	flush := func() {
+		cell := strings.Join(current, "\n")
+		if strings.TrimSpace(cell) != "" {
+			cells = append(cells, strings.Trim(cell, "\n"))
+		}
+		current = current[:0]
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), cellMarker) {
+			flush()
+			continue
+		}
+		current = append(current, line)
+	}
+	flush()
+	return cells
+}
+
+func (c *Code) ExportScriptHandler(w http.ResponseWriter, r *http.Request) {
+	attempts := false
+	if value := r.URL.Query().Get("attempts"); value != "" {
+		var err error
+		if attempts, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var current []*ExecutionState
+	if attempts {
+		current = c.state.ListStates(true)
+	}
+	script := newScript(c.state.PreviousStates(), current)
+
+	w.Header().Set("Content-Type", "text/x-python; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+c.exportName()+`.py"`)
+	if _, err := w.Write([]byte(script)); err != nil {
+		log.Println(err)
+	}
+}
+
+// newScript writes the selected states as cells, followed by the given
+// attempts as commented out cells.
+func newScript(selected, attempts []*ExecutionState) string {
+	builder := strings.Builder{}
+	for _, state := range selected {
+		builder.WriteString(cellMarker + "\n")
+		builder.WriteString(strings.TrimRight(state.Code, "\n"))
+		builder.WriteString("\n\n")
+	}
+
+	for _, state := range attempts {
+		builder.WriteString(cellMarker + " attempt " + strconv.FormatInt(state.ID, 10) + "\n")
+		for _, line := range strings.Split(strings.TrimRight(state.Code, "\n"), "\n") {
+			builder.WriteString(strings.TrimRight("# "+line, " ") + "\n")
+		}
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
@@ -1,21 +1,35 @@
 package code
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/hvaghani221/autopyter/internal/kernel"
 )
 
 type State struct {
-	PreviousState  []*ExecutionState
-	CurrentState   []*ExecutionState
-	mu             sync.RWMutex
-	preloadKernels *kernel.PreloadedKernels
+	// PreviousState is the path of the state tree from the root to head.
+	PreviousState []*ExecutionState
+	CurrentState  []*ExecutionState
+	root          *Checkpoint
+	head          *Checkpoint
+	mu            sync.RWMutex
+	// pools holds a kernel pool per target, all of them kept at the path
+	// from the root to head.
+	pools      map[string]*kernel.PreloadedKernels
+	poolConfig kernel.PoolConfig
+	kernelSpec string
 	// kernel         *kernel.Kernel
-	lastId int64
+	lastId  int64
+	timeout time.Duration
+	events  *EventBus
+	// allowBroken executes new code even when a selected state raises on
+	// replay.
+	allowBroken bool
 }
 
 type ExecutionState struct {
@@ -25,34 +39,228 @@ type ExecutionState struct {
 	Exceptions []kernel.ExceptionMessage `json:"exception,omitempty"`
 	Error      error                     `json:"error,omitempty"`
 	KernelID   string
+	KernelSpec string `json:"kernel_spec,omitempty"`
+	Target     string `json:"target,omitempty"`
+	// Grouped states were executed together on several targets.
+	Grouped   bool  `json:"grouped,omitempty"`
+	GroupID   int64 `json:"group_id,omitempty"`
+	Cancelled bool  `json:"cancelled,omitempty"`
+	// Reply is the execute_reply of the kernel, nil until it arrives.
+	Reply    *kernel.ReplyMessage `json:"reply,omitempty"`
+	Started  time.Time            `json:"started"`
+	Finished time.Time            `json:"finished"`
 	// Kernel      *kernel.Kernel           `json:"-"`
 	waitChannel chan struct{}
+	cancel      func() error
+	sendInput   func(*kernel.InputPrompt, string) error
+	input       *kernel.InputPrompt
+	output      kernel.Outputs
+	outputs     *broker[outputEvent]
+	mu          sync.Mutex
+}
+
+// outputEvent is published to the subscribers of an execution. Reset
+// replaces every output received so far by Results and Exceptions.
+type outputEvent struct {
+	kernel.Event
+	Reset      bool
+	Results    []kernel.ResultMessage
+	Exceptions []kernel.ExceptionMessage
 }
 
 func (es *ExecutionState) GetID() int64 {
 	return es.ID
 }
 
+func (es *ExecutionState) addEvent(event kernel.Event) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if event.Input != nil {
+		es.input = event.Input
+		es.outputs.Publish(outputEvent{Event: event})
+		return
+	}
+	if event.Reply != nil {
+		es.Reply = event.Reply
+		return
+	}
+	es.applyOutput(event)
+}
+
+// Duration returns how long the execution took, or has been running.
+func (es *ExecutionState) Duration() time.Duration {
+	end := es.Finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return end.Sub(es.Started).Round(time.Millisecond)
+}
+
+// applyOutput must be called with the lock held.
+func (es *ExecutionState) applyOutput(event kernel.Event) {
+	es.output.Results, es.output.Exceptions = es.Results, es.Exceptions
+	reset := es.output.Apply(event)
+	es.Results, es.Exceptions = es.output.Results, es.output.Exceptions
+
+	switch {
+	case reset:
+		results, exceptions := es.snapshot()
+		es.outputs.Publish(outputEvent{Reset: true, Results: results, Exceptions: exceptions})
+	case event.Exception != nil:
+		es.outputs.Publish(outputEvent{Event: event})
+	case event.Result != nil && event.Result.Type != kernel.UpdateDisplayData:
+		es.outputs.Publish(outputEvent{Event: event})
+	}
+}
+
+func (es *ExecutionState) snapshot() ([]kernel.ResultMessage, []kernel.ExceptionMessage) {
+	results := make([]kernel.ResultMessage, len(es.Results))
+	copy(results, es.Results)
+	exceptions := make([]kernel.ExceptionMessage, len(es.Exceptions))
+	copy(exceptions, es.Exceptions)
+	return results, exceptions
+}
+
+// PendingInput returns the prompt the execution waits on, if any.
+func (es *ExecutionState) PendingInput() *kernel.InputPrompt {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.input
+}
+
+// SendInput answers the pending prompt and echoes it to the outputs the way
+// Jupyter does, masking passwords.
+func (es *ExecutionState) SendInput(value string) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.input == nil {
+		return errors.New("no input requested")
+	}
+	prompt := es.input
+	if err := es.sendInput(prompt, value); err != nil {
+		return err
+	}
+	es.input = nil
+
+	echo := value
+	if prompt.Password {
+		echo = "········"
+	}
+	es.applyOutput(kernel.Event{Result: &kernel.ResultMessage{
+		Type:   kernel.Stream,
+		Stream: &kernel.StreamMessage{Name: "stdout", Text: prompt.Prompt + echo + "\n"},
+	}})
+	return nil
+}
+
+// Subscribe returns the outputs produced so far together with a channel
+// receiving every following output.
+func (es *ExecutionState) Subscribe() ([]kernel.ResultMessage, []kernel.ExceptionMessage, <-chan outputEvent, func()) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	results, exceptions := es.snapshot()
+	ch, cancel := es.outputs.Subscribe()
+	return results, exceptions, ch, cancel
+}
+
+func (es *ExecutionState) Done() <-chan struct{} {
+	return es.waitChannel
+}
+
 func (es *ExecutionState) WaitForResult() bool {
 	_, ok := <-es.waitChannel
 	return ok
 }
 
-func NewState() *State {
-	preloadedkernels, err := kernel.NewPreloaded()
-	if err != nil {
-		log.Fatal(err)
-	}
+func NewState(options Options, events *EventBus) *State {
+	root := newRootCheckpoint()
 	s := &State{
-		PreviousState:  []*ExecutionState{},
-		CurrentState:   []*ExecutionState{},
-		mu:             sync.RWMutex{},
-		preloadKernels: preloadedkernels,
+		PreviousState: []*ExecutionState{},
+		CurrentState:  []*ExecutionState{},
+		root:          root,
+		head:          root,
+		mu:            sync.RWMutex{},
+		pools:         map[string]*kernel.PreloadedKernels{},
+		poolConfig:    options.Pool,
+		kernelSpec:    options.KernelSpec,
+		timeout:       options.Timeout,
+		events:        events,
+	}
+	if s.kernelSpec == "" {
+		s.kernelSpec = kernel.DefaultKernelSpec
+	}
+	if _, err := s.pool(s.target(s.kernelSpec)); err != nil {
+		log.Fatal(err)
 	}
 
 	return s
 }
 
+func (s *State) target(spec string) kernel.Target {
+	return kernel.Target{Server: kernel.DefaultServer(), Spec: spec}
+}
+
+// pool returns the kernel pool of target and creates it on first use, it
+// must be called with the lock held.
+func (s *State) pool(target kernel.Target) (*kernel.PreloadedKernels, error) {
+	if pool, ok := s.pools[target.String()]; ok {
+		return pool, nil
+	}
+	pool, err := kernel.NewPreloaded(target, s.getPreviousCells(), s.poolConfig)
+	if err != nil {
+		return nil, err
+	}
+	pool.OnStatusChange(func() {
+		s.events.Emit(ReplayChanged, -1)
+	})
+	s.pools[target.String()] = pool
+	return pool, nil
+}
+
+// resetPools replays the path from the root to head on every pool, it must
+// be called with the lock held.
+func (s *State) resetPools() error {
+	cells := s.getPreviousCells()
+	for _, pool := range s.pools {
+		if err := pool.Reset(cells); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendPools advances every pool by cell, it must be called with the lock
+// held.
+func (s *State) appendPools(cell string) error {
+	for _, pool := range s.pools {
+		if err := pool.Append(cell); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *State) SetKernelSpec(spec string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.pool(s.target(spec)); err != nil {
+		return err
+	}
+	s.kernelSpec = spec
+	s.events.Emit(KernelSpecChanged, -1)
+	return nil
+}
+
+func (s *State) KernelSpec() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.kernelSpec
+}
+
 func (s *State) Select(id int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -69,38 +277,211 @@ func (s *State) Select(id int64) error {
 		return errors.New("state not found")
 	}
 
-	s.PreviousState = append(s.PreviousState, executionState)
+	s.head = s.head.addChild(executionState)
+	s.PreviousState = s.head.path()
 
 	s.CurrentState = s.CurrentState[:0]
 
-	if err := s.preloadKernels.Reset(s.getPreviousCode()); err != nil {
+	if err := s.appendPools(executionState.Code); err != nil {
 		return err
 	}
+	s.events.Emit(StateSelected, id)
 	return nil
 }
 
-func (s *State) getPreviousCode() string {
-	if len(s.PreviousState) == 0 {
-		return ""
+func (s *State) Checkout(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	checkpoint := s.root.find(id)
+	if checkpoint == nil {
+		return errors.New("state not found")
+	}
+	if checkpoint == s.head {
+		return nil
 	}
-	builder := strings.Builder{}
+
+	s.head = checkpoint
+	s.PreviousState = s.head.path()
+	s.CurrentState = s.CurrentState[:0]
+
+	if err := s.resetPools(); err != nil {
+		return err
+	}
+	s.events.Emit(HeadChanged, id)
+	return nil
+}
+
+// Import replaces the state tree with a single chain of the given cells.
+func (s *State) Import(cells []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.root = newRootCheckpoint()
+	s.head = s.root
+	for _, cell := range cells {
+		s.head = s.head.addChild(restoreExecutionState(SavedState{
+			Code: cell,
+			ID:   s.lastId,
+		}))
+		s.lastId++
+	}
+	s.PreviousState = s.head.path()
+	s.CurrentState = s.CurrentState[:0]
+
+	if err := s.resetPools(); err != nil {
+		return err
+	}
+	s.events.Emit(StateReset, -1)
+	return nil
+}
+
+func (s *State) Tree() []CheckpointView {
+	failedID := int64(-1)
+	if state, _ := s.ReplayFailure(); state != nil {
+		failedID = state.ID
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.root.view(s.head, failedID)
+}
+
+func (s *State) SetAllowBroken(allow bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.allowBroken = allow
+	s.events.Emit(ReplayChanged, -1)
+}
+
+func (s *State) AllowBroken() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.allowBroken
+}
+
+func (s *State) getPreviousCells() []string {
+	cells := make([]string, 0, len(s.PreviousState))
 	for _, state := range s.PreviousState {
-		builder.WriteString(state.Code)
-		builder.WriteString("\n")
+		cells = append(cells, state.Code)
 	}
-	return builder.String()
+	return cells
 }
 
 func (s *State) Execute(code string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// kernel := s.kernel
-	kernel, err := s.preloadKernels.Get()
+	state, err := s.execute(s.target(s.kernelSpec), code)
 	if err != nil {
 		return err
 	}
 
+	s.CurrentState = append(s.CurrentState, state)
+	s.events.Emit(ExecutionStarted, state.ID)
+	return nil
+}
+
+// ExecuteAll executes code on every target and groups the resulting states
+// so they can be compared, it returns the ID of the group. Targets without a
+// pool get a kernel of their own, replayed without holding the lock so that
+// comparing does not start pools that every later Select and Reset would
+// have to replay.
+func (s *State) ExecuteAll(code string, targets []kernel.Target) (int64, error) {
+	s.mu.RLock()
+	cells, allowBroken := s.getPreviousCells(), s.allowBroken
+	kernels := make([]*kernel.Kernel, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		if _, ok := s.pools[target.String()]; ok {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, target kernel.Target) {
+			defer wg.Done()
+			kernels[i], errs[i] = kernel.ReplayKernel(target, cells, allowBroken)
+		}(i, target)
+	}
+	s.mu.RUnlock()
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// removing a selected cell changes the cells without moving head
+	if !equalCells(cells, s.getPreviousCells()) {
+		for _, k := range kernels {
+			if k != nil {
+				k.Close()
+			}
+		}
+		return -1, errors.New("the selected cells changed while the kernels were starting")
+	}
+
+	var states []*ExecutionState
+	for i, target := range targets {
+		if errs[i] != nil {
+			errs[i] = fmt.Errorf("%s: %w", target, errs[i])
+			continue
+		}
+		var state *ExecutionState
+		var err error
+		if kernels[i] != nil {
+			state = s.start(target, kernels[i], code)
+		} else if state, err = s.execute(target, code); err != nil {
+			errs[i] = fmt.Errorf("%s: %w", target, err)
+			continue
+		}
+		states = append(states, state)
+	}
+	if len(states) == 0 {
+		return -1, errors.Join(append(errs, errors.New("no target to execute on"))...)
+	}
+
+	groupID := states[0].ID
+	for _, state := range states {
+		state.Grouped = true
+		state.GroupID = groupID
+		s.CurrentState = append(s.CurrentState, state)
+		s.events.Emit(ExecutionStarted, state.ID)
+	}
+	return groupID, errors.Join(errs...)
+}
+
+func equalCells(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// execute starts code on a kernel of target, it must be called with the
+// lock held.
+func (s *State) execute(target kernel.Target, code string) (*ExecutionState, error) {
+	pool, err := s.pool(target)
+	if err != nil {
+		return nil, err
+	}
+	// kernel := s.kernel
+	k, err := pool.Get(s.allowBroken)
+	if err != nil {
+		return nil, err
+	}
+	return s.start(target, k, code), nil
+}
+
+// start executes code on k, which is closed once the execution finishes. It
+// must be called with the lock held.
+func (s *State) start(target kernel.Target, k *kernel.Kernel, code string) *ExecutionState {
+	outputs := newBroker[outputEvent]()
+
 	// log.Println("executing code on kernel", kernel.ID)
 
 	waitChan := make(chan struct{})
@@ -109,19 +490,88 @@ func (s *State) Execute(code string) error {
 		ID:   s.lastId,
 		// Kernel:      kernel,
 		waitChannel: waitChan,
-		KernelID:    kernel.ID,
+		KernelID:    k.ID,
+		KernelSpec:  target.Spec,
+		Target:      target.String(),
+		Started:     time.Now(),
+		cancel:      k.Interrupt,
+		sendInput:   k.SendInput,
+		outputs:     outputs,
 	}
 	s.lastId++
 	go func() {
-		res, exc, err := kernel.ExecuteCode(code)
-		state.Results = res
-		state.Exceptions = exc
+		ctx, cancel := context.WithCancel(context.Background())
+		if s.timeout > 0 {
+			ctx, cancel = kernel.WithTimeout(context.Background(), s.timeout)
+		}
+		defer cancel()
+
+		// the outputs are collected by addEvent, the reply is published there
+		// as well as soon as it arrives
+		_, _, reply, err := k.ExecuteCodeStream(ctx, code, state.addEvent)
+		state.mu.Lock()
+		if reply != nil {
+			state.Reply = reply
+		}
 		state.Error = err
+		state.Finished = time.Now()
+		state.input = nil
+		state.mu.Unlock()
 		close(waitChan)
-		kernel.Close()
+		s.events.Emit(ExecutionFinished, state.ID)
+		k.Close()
 	}()
 
-	s.CurrentState = append(s.CurrentState, state)
+	return state
+}
+
+// Group returns the states executed together by ExecuteAll.
+func (s *State) Group(groupID int64) []*ExecutionState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var states []*ExecutionState
+	for _, state := range s.CurrentState {
+		if state.Grouped && state.GroupID == groupID {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+func (s *State) Cancel(id int64) error {
+	s.mu.RLock()
+	var state *ExecutionState
+	for _, candidate := range s.CurrentState {
+		if candidate.ID == id {
+			state = candidate
+			break
+		}
+	}
+	s.mu.RUnlock()
+	if state == nil {
+		return errors.New("state not found")
+	}
+
+	// Cancelled is set before interrupting, the execution sets Finished
+	// under the same lock before it closes waitChannel, so readers waiting
+	// for it see Cancelled
+	state.mu.Lock()
+	if !state.Finished.IsZero() || state.cancel == nil {
+		state.mu.Unlock()
+		return errors.New("execution already finished")
+	}
+	state.Cancelled = true
+	cancel := state.cancel
+	state.mu.Unlock()
+
+	if err := cancel(); err != nil {
+		// the kernel was not interrupted and keeps running
+		state.mu.Lock()
+		state.Cancelled = false
+		state.mu.Unlock()
+		return err
+	}
 	return nil
 }
 
@@ -139,16 +589,66 @@ func (s *State) ListStates(current bool) []*ExecutionState {
 	res := make([]*ExecutionState, 0, len(list))
 	for _, state := range list {
 		res = append(res, &ExecutionState{
-			Code:     state.Code,
-			ID:       state.ID,
-			KernelID: state.KernelID,
+			Code:       state.Code,
+			ID:         state.ID,
+			KernelID:   state.KernelID,
+			KernelSpec: state.KernelSpec,
+			Target:     state.Target,
+			Grouped:    state.Grouped,
+			GroupID:    state.GroupID,
+			Started:    state.Started,
 		})
 	}
 	return res
 }
 
+func (s *State) PreviousStates() []*ExecutionState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	states := make([]*ExecutionState, len(s.PreviousState))
+	copy(states, s.PreviousState)
+	return states
+}
+
+// ReplayFailure returns the selected state that no longer replays cleanly
+// together with the error, or nil when replaying works.
+func (s *State) ReplayFailure() (*ExecutionState, *kernel.ReplayError) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pool, ok := s.pools[s.target(s.kernelSpec).String()]
+	if !ok {
+		return nil, nil
+	}
+	replayErr := pool.ReplayError()
+	if replayErr == nil {
+		return nil, nil
+	}
+	if replayErr.Cell < 0 || replayErr.Cell >= len(s.PreviousState) {
+		return nil, replayErr
+	}
+	return s.PreviousState[replayErr.Cell], replayErr
+}
+
+func (s *State) PoolStats() map[string]kernel.PoolStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := make(map[string]kernel.PoolStats, len(s.pools))
+	for spec, pool := range s.pools {
+		stats[spec] = pool.Stats()
+	}
+	return stats
+}
+
 func (s *State) Close() {
-	s.preloadKernels.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pool := range s.pools {
+		pool.Close()
+	}
 }
 
 func (s *State) GetState(id int64) *ExecutionState {
@@ -170,6 +670,7 @@ func (s *State) RemoveState(id int64) bool {
 	for i, state := range s.CurrentState {
 		if state.ID == id {
 			s.CurrentState = append(s.CurrentState[:i], s.CurrentState[i+1:]...)
+			s.events.Emit(ExecutionRemoved, id)
 			return true
 		}
 	}
@@ -180,33 +681,40 @@ func (s *State) RemovePreviousState(id int64) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for i, state := range s.PreviousState {
-		if state.ID == id {
-			s.PreviousState = append(s.PreviousState[:i], s.PreviousState[i+1:]...)
-			go func() {
-				if err := s.preloadKernels.Reset(s.getPreviousCode()); err != nil {
-					log.Println(err)
-				}
-			}()
-			return true
-		}
+	checkpoint := s.root.find(id)
+	if checkpoint == nil {
+		return false
 	}
 
-	return false
+	onPath := checkpoint.isAncestorOf(s.head)
+	if checkpoint == s.head {
+		s.head = checkpoint.Parent
+	}
+	checkpoint.detach()
+	s.PreviousState = s.head.path()
+
+	if onPath {
+		if err := s.resetPools(); err != nil {
+			log.Println(err)
+		}
+	}
+	return true
 }
 
 func (s *State) ResetState(currentOnly bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if !currentOnly {
-		s.PreviousState = s.PreviousState[:0]
+	s.CurrentState = s.CurrentState[:0]
+	s.events.Emit(StateReset, -1)
+	if currentOnly {
+		return
 	}
 
-	s.CurrentState = s.CurrentState[:0]
-	go func() {
-		if err := s.preloadKernels.Reset(s.getPreviousCode()); err != nil {
-			log.Println(err)
-		}
-	}()
+	s.root = newRootCheckpoint()
+	s.head = s.root
+	s.PreviousState = s.head.path()
+	if err := s.resetPools(); err != nil {
+		log.Println(err)
+	}
 }
@@ -0,0 +1,182 @@
+package code
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hvaghani221/autopyter/internal/kernel"
+	"github.com/hvaghani221/autopyter/internal/kernel/kerneltest"
+)
+
+var fake *kerneltest.Server
+
+func TestMain(m *testing.M) {
+	fake = kerneltest.NewServer("secret", kerneltest.Options{})
+	server, err := kernel.NewServer(kernel.DefaultServerName, fake.URL, "secret", kernel.ServerOptions{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := kernel.InitKernel(server, false); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	fake.Close()
+	os.Exit(code)
+}
+
+func newTestState(t *testing.T) *State {
+	t.Helper()
+	state := NewState(Options{Pool: kernel.PoolConfig{MinSize: 1, MaxSize: 2}}, NewEventBus())
+	t.Cleanup(state.Close)
+	return state
+}
+
+// executeAndWait executes code and returns its state once it finished.
+func executeAndWait(t *testing.T, s *State, code string) *ExecutionState {
+	t.Helper()
+	if err := s.Execute(code); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.RLock()
+	state := s.CurrentState[len(s.CurrentState)-1]
+	s.mu.RUnlock()
+
+	state.WaitForResult()
+	if state.Error != nil {
+		t.Fatal(state.Error)
+	}
+	return state
+}
+
+func TestStateExecuteSelect(t *testing.T) {
+	fake.Script("print(a)", kerneltest.Stream("stdout", "1\n"))
+	s := newTestState(t)
+
+	first := executeAndWait(t, s, "a = 1")
+	if err := s.Select(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if cells := s.getPreviousCells(); !reflect.DeepEqual(cells, []string{"a = 1"}) {
+		t.Fatalf("selected cells %q, want %q", cells, []string{"a = 1"})
+	}
+
+	second := executeAndWait(t, s, "print(a)")
+	if len(second.Results) != 1 || second.Results[0].Stream == nil || second.Results[0].Stream.Text != "1\n" {
+		t.Fatalf("unexpected results: %+v", second.Results)
+	}
+	history := fake.Kernel(second.KernelID).History()
+	if want := []string{"a = 1", "print(a)"}; !reflect.DeepEqual(history, want) {
+		t.Fatalf("kernel ran %q, want %q", history, want)
+	}
+}
+
+func TestStateExecuteAll(t *testing.T) {
+	fake.SetKernelSpecs(kerneltest.DefaultKernelSpec, "other")
+	t.Cleanup(func() { fake.SetKernelSpecs(kerneltest.DefaultKernelSpec) })
+	s := newTestState(t)
+
+	targets := []kernel.Target{s.target(kerneltest.DefaultKernelSpec), s.target("other")}
+	groupID, err := s.ExecuteAll("a = 1", targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := s.Group(groupID)
+	if len(group) != 2 {
+		t.Fatalf("group has %d states, want 2", len(group))
+	}
+	for i, state := range group {
+		state.WaitForResult()
+		if state.Error != nil {
+			t.Fatal(state.Error)
+		}
+		if state.Target != targets[i].String() {
+			t.Fatalf("state ran on %s, want %s", state.Target, targets[i])
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.pools["other"]; ok {
+		t.Fatal("comparing started a pool for the other kernelspec")
+	}
+}
+
+func TestStateCancel(t *testing.T) {
+	fake.Script("sleep", kerneltest.Delay(time.Second))
+	s := newTestState(t)
+
+	if err := s.Execute("sleep"); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.RLock()
+	state := s.CurrentState[0]
+	s.mu.RUnlock()
+
+	// an interrupt arriving before the kernel started executing is lost,
+	// and the kernel is shut down once the execution finished
+	fakeKernel := fake.Kernel(state.KernelID)
+	for fakeKernel.State() != "busy" {
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.Cancel(state.ID); err != nil {
+		t.Fatal(err)
+	}
+	state.WaitForResult()
+	if !state.Cancelled {
+		t.Fatal("the state is not marked cancelled")
+	}
+	if len(state.Exceptions) != 1 || state.Exceptions[0].EName != "KeyboardInterrupt" {
+		t.Fatalf("got exceptions %+v, want KeyboardInterrupt", state.Exceptions)
+	}
+	if interrupts := fakeKernel.Interrupts(); interrupts != 1 {
+		t.Fatalf("interrupted %d times, want 1", interrupts)
+	}
+	if err := s.Cancel(state.ID); err == nil {
+		t.Fatal("cancelling a finished execution succeeded")
+	}
+}
+
+func TestStateExecuteAllCellsChanged(t *testing.T) {
+	fake.SetKernelSpecs(kerneltest.DefaultKernelSpec, "other")
+	t.Cleanup(func() { fake.SetKernelSpecs(kerneltest.DefaultKernelSpec) })
+	fake.Script("slow", kerneltest.Delay(300*time.Millisecond))
+	s := newTestState(t)
+
+	first := executeAndWait(t, s, "slow")
+	if err := s.Select(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	second := executeAndWait(t, s, "b = 2")
+	if err := s.Select(second.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.ExecuteAll("c = 3", []kernel.Target{s.target("other")})
+		errs <- err
+	}()
+	// remove an ancestor of head while the comparison kernel replays it
+	for !replaying(fake, "other") {
+		time.Sleep(time.Millisecond)
+	}
+	if !s.RemovePreviousState(first.ID) {
+		t.Fatal("the first cell was not removed")
+	}
+	if err := <-errs; err == nil {
+		t.Fatal("ExecuteAll ran on a kernel replaying the removed cell")
+	}
+}
+
+func replaying(fake *kerneltest.Server, spec string) bool {
+	for _, candidate := range fake.Kernels() {
+		if candidate.Name == spec && candidate.State() == "busy" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,22 @@
+package code
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/hvaghani221/autopyter/internal/kernel"
+)
+
+func (c *Code) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	status := struct {
+		Pools map[string]kernel.PoolStats `json:"pools"`
+	}{
+		Pools: c.state.PoolStats(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Println(err)
+	}
+}
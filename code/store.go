@@ -0,0 +1,267 @@
+package code
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hvaghani221/autopyter/internal/kernel"
+)
+
+type Store interface {
+	Save(session *Session) error
+	// Load returns an error wrapping os.ErrNotExist for unknown sessions.
+	Load(name string) (*Session, error)
+}
+
+type Session struct {
+	Name          string        `json:"name"`
+	History       []HistoryItem `json:"history"`
+	HistoryLastID int64         `json:"history_last_id"`
+	// Checkpoints are stored parents first, ParentID -1 refers to the root.
+	Checkpoints []SavedState `json:"checkpoints"`
+	Current     []SavedState `json:"current"`
+	Head        int64        `json:"head"`
+	LastID      int64        `json:"last_id"`
+	KernelSpec  string       `json:"kernel_spec,omitempty"`
+}
+
+type SavedState struct {
+	Code       string                    `json:"code"`
+	ID         int64                     `json:"id"`
+	ParentID   int64                     `json:"parent_id"`
+	KernelSpec string                    `json:"kernel_spec,omitempty"`
+	Target     string                    `json:"target,omitempty"`
+	Grouped    bool                      `json:"grouped,omitempty"`
+	GroupID    int64                     `json:"group_id,omitempty"`
+	Results    []kernel.ResultMessage    `json:"result,omitempty"`
+	Exceptions []kernel.ExceptionMessage `json:"exception,omitempty"`
+	Error      string                    `json:"error,omitempty"`
+	Cancelled  bool                      `json:"cancelled,omitempty"`
+	Reply      *kernel.ReplyMessage      `json:"reply,omitempty"`
+	Started    time.Time                 `json:"started"`
+	Finished   time.Time                 `json:"finished"`
+}
+
+type FileStore struct {
+	Dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStore{Dir: dir}, nil
+}
+
+func (fs *FileStore) Save(session *Session) error {
+	content, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(fs.Dir, session.Name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.path(session.Name))
+}
+
+func (fs *FileStore) Load(name string) (*Session, error) {
+	content, err := os.ReadFile(fs.path(name))
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	if err := json.Unmarshal(content, &session); err != nil {
+		return nil, err
+	}
+	session.Name = name
+	return &session, nil
+}
+
+func (fs *FileStore) path(name string) string {
+	return filepath.Join(fs.Dir, filepath.Base(name)+".json")
+}
+
+func (c *Code) persist() {
+	events, cancel := c.events.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case <-c.closeChan:
+			return
+		case <-events:
+			c.save()
+		}
+	}
+}
+
+func (c *Code) save() {
+	if c.store == nil {
+		return
+	}
+	session := c.state.snapshot()
+	session.Name = c.session
+	session.History, session.HistoryLastID = c.history.snapshot()
+	if err := c.store.Save(session); err != nil {
+		log.Println("saving session", c.session, err)
+	}
+}
+
+func (c *Code) restore() error {
+	session, err := c.store.Load(c.session)
+	if err != nil {
+		return err
+	}
+	c.history.restore(session.History, session.HistoryLastID)
+	return c.state.restore(session)
+}
+
+func (h *History) snapshot() ([]HistoryItem, int64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	items := make([]HistoryItem, len(h.Items))
+	copy(items, h.Items)
+	return items, h.lastID
+}
+
+func (h *History) restore(items []HistoryItem, lastID int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Items = items
+	h.lastID = lastID
+}
+
+func (es *ExecutionState) save(parentID int64) SavedState {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	saved := SavedState{
+		Code:       es.Code,
+		ID:         es.ID,
+		ParentID:   parentID,
+		KernelSpec: es.KernelSpec,
+		Target:     es.Target,
+		Grouped:    es.Grouped,
+		GroupID:    es.GroupID,
+		Results:    es.Results,
+		Exceptions: es.Exceptions,
+		Cancelled:  es.Cancelled,
+		Reply:      es.Reply,
+		Started:    es.Started,
+		Finished:   es.Finished,
+	}
+	if es.Error != nil {
+		saved.Error = es.Error.Error()
+	}
+	return saved
+}
+
+func (s *State) snapshot() *Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session := &Session{
+		Head:       -1,
+		LastID:     s.lastId,
+		KernelSpec: s.kernelSpec,
+	}
+	if s.head.State != nil {
+		session.Head = s.head.State.ID
+	}
+
+	var walk func(checkpoint *Checkpoint, parentID int64)
+	walk = func(checkpoint *Checkpoint, parentID int64) {
+		for _, child := range checkpoint.Children {
+			session.Checkpoints = append(session.Checkpoints, child.State.save(parentID))
+			walk(child, child.State.ID)
+		}
+	}
+	walk(s.root, -1)
+
+	for _, state := range s.CurrentState {
+		select {
+		case <-state.Done():
+			session.Current = append(session.Current, state.save(-1))
+		default:
+		}
+	}
+	return session
+}
+
+func (s *State) restore(session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	root := newRootCheckpoint()
+	checkpoints := map[int64]*Checkpoint{-1: root}
+	for _, saved := range session.Checkpoints {
+		parent, ok := checkpoints[saved.ParentID]
+		if !ok {
+			return errors.New("session has a checkpoint without parent")
+		}
+		checkpoints[saved.ID] = parent.addChild(restoreExecutionState(saved))
+	}
+
+	head, ok := checkpoints[session.Head]
+	if !ok {
+		return errors.New("session head not found")
+	}
+
+	s.root = root
+	s.head = head
+	s.PreviousState = head.path()
+	s.CurrentState = s.CurrentState[:0]
+	for _, saved := range session.Current {
+		s.CurrentState = append(s.CurrentState, restoreExecutionState(saved))
+	}
+	s.lastId = session.LastID
+
+	if session.KernelSpec != "" {
+		if _, err := s.pool(s.target(session.KernelSpec)); err != nil {
+			return err
+		}
+		s.kernelSpec = session.KernelSpec
+	}
+	return s.resetPools()
+}
+
+func restoreExecutionState(saved SavedState) *ExecutionState {
+	waitChan := make(chan struct{})
+	close(waitChan)
+	state := &ExecutionState{
+		Code:        saved.Code,
+		ID:          saved.ID,
+		KernelSpec:  saved.KernelSpec,
+		Target:      saved.Target,
+		Grouped:     saved.Grouped,
+		GroupID:     saved.GroupID,
+		Results:     saved.Results,
+		Exceptions:  saved.Exceptions,
+		Cancelled:   saved.Cancelled,
+		Reply:       saved.Reply,
+		Started:     saved.Started,
+		Finished:    saved.Finished,
+		waitChannel: waitChan,
+		outputs:     newBroker[outputEvent](),
+	}
+	if saved.Error != "" {
+		state.Error = errors.New(saved.Error)
+	}
+	return state
+}
@@ -0,0 +1,103 @@
+package code
+
+// Checkpoint is a node of the state tree. The root checkpoint has no
+// state, every other checkpoint holds a selected execution whose code runs
+// on top of the code of all its ancestors.
+type Checkpoint struct {
+	State    *ExecutionState
+	Parent   *Checkpoint
+	Children []*Checkpoint
+}
+
+type CheckpointView struct {
+	Code   string
+	ID     int64
+	Head   bool
+	Active bool
+	// ReplayFailed marks the state that raises when it is replayed.
+	ReplayFailed bool
+	Children     []CheckpointView
+}
+
+func newRootCheckpoint() *Checkpoint {
+	return &Checkpoint{}
+}
+
+func (c *Checkpoint) addChild(state *ExecutionState) *Checkpoint {
+	child := &Checkpoint{
+		State:  state,
+		Parent: c,
+	}
+	c.Children = append(c.Children, child)
+	return child
+}
+
+func (c *Checkpoint) find(id int64) *Checkpoint {
+	if c.State != nil && c.State.ID == id {
+		return c
+	}
+	for _, child := range c.Children {
+		if found := child.find(id); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// path returns the states from the root down to c.
+func (c *Checkpoint) path() []*ExecutionState {
+	var states []*ExecutionState
+	for node := c; node != nil && node.State != nil; node = node.Parent {
+		states = append(states, node.State)
+	}
+	for i, j := 0, len(states)-1; i < j; i, j = i+1, j-1 {
+		states[i], states[j] = states[j], states[i]
+	}
+	return states
+}
+
+func (c *Checkpoint) isAncestorOf(node *Checkpoint) bool {
+	for ; node != nil; node = node.Parent {
+		if node == c {
+			return true
+		}
+	}
+	return false
+}
+
+// detach removes c from the tree and hands its children over to its parent.
+func (c *Checkpoint) detach() {
+	parent := c.Parent
+	for i, child := range parent.Children {
+		if child != c {
+			continue
+		}
+		children := make([]*Checkpoint, 0, len(parent.Children)+len(c.Children)-1)
+		children = append(children, parent.Children[:i]...)
+		for _, grandchild := range c.Children {
+			grandchild.Parent = parent
+			children = append(children, grandchild)
+		}
+		children = append(children, parent.Children[i+1:]...)
+		parent.Children = children
+		break
+	}
+	c.Parent = nil
+	c.Children = nil
+}
+
+func (c *Checkpoint) view(head *Checkpoint, failedID int64) []CheckpointView {
+	views := make([]CheckpointView, 0, len(c.Children))
+	for _, child := range c.Children {
+		active := child.isAncestorOf(head)
+		views = append(views, CheckpointView{
+			Code:         child.State.Code,
+			ID:           child.State.ID,
+			Head:         child == head,
+			Active:       active,
+			ReplayFailed: active && child.State.ID == failedID,
+			Children:     child.view(head, failedID),
+		})
+	}
+	return views
+}
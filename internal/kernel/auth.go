@@ -0,0 +1,99 @@
+package kernel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	TokenEnv    = "JUPYTER_TOKEN"
+	PasswordEnv = "JUPYTER_PASSWORD"
+
+	xsrfCookie = "_xsrf"
+	xsrfHeader = "X-XSRFToken"
+)
+
+// ReadCredential returns value if it is set, otherwise the content of file,
+// otherwise the environment variable env.
+func ReadCredential(value, file, env string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	return os.Getenv(env), nil
+}
+
+// Login authenticates with the password of the server, the session and the
+// XSRF cookies are kept in the cookie jar of the server.
+func (s *Server) Login() error {
+	s.loginMu.Lock()
+	defer s.loginMu.Unlock()
+
+	if s.password == "" {
+		return fmt.Errorf("no password configured for server %s", s.Name)
+	}
+	loginUrl := s.endpoint("login")
+
+	// The login page sets the _xsrf cookie the form has to echo.
+	req, err := http.NewRequest("GET", loginUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header = s.Header.Clone()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	form := url.Values{"password": {s.password}}
+	if xsrf := s.cookie(xsrfCookie); xsrf != "" {
+		form.Set(xsrfCookie, xsrf)
+	}
+	header := s.Header.Clone()
+	header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// A successful login redirects, a failed one renders the login page again.
+	client := *s.client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	req, err = http.NewRequest("POST", loginUrl.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	resp, err = client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		return fmt.Errorf("login to server %s failed, status: %s", s.Name, resp.Status)
+	}
+	return nil
+}
+
+func (s *Server) cookie(name string) string {
+	// Jupyter scopes its cookies to the base path with a trailing slash.
+	base := *s.URL
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/"
+	for _, cookie := range s.client.Jar.Cookies(&base) {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,67 @@
+package kernel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrDisconnected = errors.New("kernel connection lost")
+	ErrKernelGone   = errors.New("kernel is gone")
+)
+
+type timeoutKey struct{}
+
+// WithTimeout behaves like context.WithTimeout, and makes executions report
+// timeout itself in their TimeoutError.
+func WithTimeout(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(parent, timeoutKey{}, timeout)
+	return context.WithTimeout(ctx, timeout)
+}
+
+func newTimeoutError(ctx context.Context, start time.Time) *TimeoutError {
+	if timeout, ok := ctx.Value(timeoutKey{}).(time.Duration); ok {
+		return &TimeoutError{Timeout: timeout}
+	}
+	deadline, _ := ctx.Deadline()
+	return &TimeoutError{Timeout: deadline.Sub(start)}
+}
+
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s", e.Timeout)
+}
+
+// KernelDiedError reports a kernel that died or restarted while it was in
+// use, together with the last status the server reported for it.
+type KernelDiedError struct {
+	Status string
+}
+
+func (e *KernelDiedError) Error() string {
+	return fmt.Sprintf("kernel died, last status: %s", e.Status)
+}
+
+// ReplayError reports the previously selected cell that could not be
+// replayed on a preloaded kernel.
+type ReplayError struct {
+	Cell      int
+	Err       error
+	Exception *ExceptionMessage
+}
+
+func (e *ReplayError) Error() string {
+	if e.Exception != nil {
+		return fmt.Sprintf("replaying cell %d raised %s: %s", e.Cell+1, e.Exception.EName, e.Exception.EValue)
+	}
+	return fmt.Sprintf("replaying cell %d: %v", e.Cell+1, e.Err)
+}
+
+func (e *ReplayError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,118 @@
+package kernel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// HeartbeatInterval is how often the liveness of a kernel is checked, 0
+// disables the checks.
+var HeartbeatInterval = 10 * time.Second
+
+// Alive reports whether the kernel can still execute code. A kernel that
+// restarted lost its state and is not alive either.
+func (k *Kernel) Alive() bool {
+	select {
+	case <-k.lostChan:
+		return false
+	case <-k.closeChan:
+		return false
+	default:
+		return true
+	}
+}
+
+// Status returns the last execution state reported for the kernel.
+func (k *Kernel) Status() string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.status
+}
+
+func (k *Kernel) setStatus(status string) {
+	if status == "" {
+		return
+	}
+	k.mu.Lock()
+	k.status = status
+	k.mu.Unlock()
+
+	switch status {
+	case "dead", "restarting", "autorestarting":
+		log.Println("kernel", k.ID, "died, status:", status)
+		k.lose(&KernelDiedError{Status: status})
+	}
+}
+
+func (k *Kernel) heartbeat() {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.closeChan:
+			return
+		case <-k.lostChan:
+			return
+		case <-ticker.C:
+			k.checkAlive()
+		}
+	}
+}
+
+// checkAlive asks the server for the state of the kernel and, while no code
+// runs on it, whether it answers a kernel_info_request on the shell channel.
+func (k *Kernel) checkAlive() {
+	status, err := k.server.kernelStatus(k.ID)
+	if errors.Is(err, ErrKernelGone) {
+		log.Println("kernel", k.ID, "is gone")
+		k.lose(&KernelDiedError{Status: k.Status()})
+		return
+	}
+	if err != nil {
+		// the websocket reconnects or gives up if the server is unreachable
+		log.Println("checking kernel", k.ID, err)
+		return
+	}
+	k.setStatus(status)
+	if status != "idle" || len(k.pendingRequests()) > 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HeartbeatInterval)
+	defer cancel()
+	// a request sent meanwhile delays the reply until it is done
+	if err := k.Ping(ctx); err != nil && k.Alive() && len(k.pendingRequests()) == 0 {
+		log.Println("kernel", k.ID, "does not answer:", err)
+		k.lose(&KernelDiedError{Status: k.Status()})
+	}
+}
+
+func (s *Server) kernelStatus(id string) (string, error) {
+	resp, err := s.do("GET", s.endpoint("api/kernels", id), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	respBytes, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrKernelGone
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("resp: %s, status code: %s", string(respBytes), resp.Status)
+	}
+	var model struct {
+		ExecutionState string `json:"execution_state"`
+	}
+	if err := json.Unmarshal(respBytes, &model); err != nil {
+		return "", err
+	}
+	return model.ExecutionState, nil
+}
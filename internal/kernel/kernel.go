@@ -2,7 +2,9 @@ package kernel
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -17,56 +19,44 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-var (
-	host, token string
-	debug       bool
-)
+var debug bool
 
-func InitKernel(kernelHost, kernelToken string, debugFlag bool) {
-	host = kernelHost
-	token = kernelToken
+func InitKernel(server *Server, debugFlag bool) error {
 	debug = debugFlag
 
 	if debug {
 		_ = os.RemoveAll("logs/")
 		_ = os.MkdirAll("logs", 0o777)
 	}
+	return RegisterServer(server)
 }
 
 type Kernel struct {
 	ID           string
+	Name         string
+	server       *Server
 	closeChan    chan struct{}
 	codeRequests map[string]*executeRequest
+	replies      map[string]chan Message
 	conn         *websocket.Conn
+	writeMu      sync.Mutex
 	messageChan  chan Message
+	lostChan     chan struct{}
+	lostErr      error
+	lostOnce     sync.Once
+	status       string
 	sessionId    string
 	file         *os.File
 	mu           sync.Mutex
 }
 
-func CreateKernel() (*Kernel, error) {
-	if host == "" {
-		return nil, fmt.Errorf("host is not initialized")
-	}
-	header := http.Header{}
-	if token != "" {
-		header.Add("Authorization", "token "+token)
-	}
-
-	kernelUrl := url.URL{Scheme: "http", Host: host, Path: "/api/kernels"}
-
+func (s *Server) CreateKernel(spec string) (*Kernel, error) {
 	reqBody := map[string]any{
-		"name": "python3",
+		"name": spec,
 	}
 	content, _ := json.Marshal(reqBody)
 
-	req, err := http.NewRequest("POST", kernelUrl.String(), bytes.NewBuffer(content))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header = header
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.do("POST", s.endpoint("api/kernels"), bytes.NewBuffer(content))
 	if err != nil {
 		return nil, err
 	}
@@ -89,100 +79,295 @@ func CreateKernel() (*Kernel, error) {
 	}
 
 	kernel.mu = sync.Mutex{}
+	kernel.server = s
 
 	kernel.sessionId = uuid.New().String()
 	kernel.codeRequests = make(map[string]*executeRequest)
+	kernel.replies = make(map[string]chan Message)
 
 	kernel.closeChan = make(chan struct{})
+	kernel.lostChan = make(chan struct{})
 	if err = kernel.listenToKernel(); err != nil {
 		return nil, err
 	}
 	go kernel.handleKernelMessages()
+	if HeartbeatInterval > 0 {
+		go kernel.heartbeat()
+	}
 	return &kernel, nil
 }
 
-func (k *Kernel) ExecuteCode(code string) ([]ResultMessage, []ExceptionMessage, error) {
+// ExecuteCode executes code and returns its outputs together with the
+// execute_reply, which carries the status, the execution count and the
+// payloads of the execution.
+func (k *Kernel) ExecuteCode(code string) ([]ResultMessage, []ExceptionMessage, *ReplyMessage, error) {
+	return k.ExecuteCodeContext(context.Background(), code)
+}
+
+func (k *Kernel) ExecuteCodeContext(ctx context.Context, code string) ([]ResultMessage, []ExceptionMessage, *ReplyMessage, error) {
+	return k.ExecuteCodeStream(ctx, code, nil)
+}
+
+// ExecuteCodeStream behaves like ExecuteCodeContext and additionally calls
+// handler with every output as soon as the kernel publishes it. The code may
+// read from stdin, handler must answer the prompts with SendInput.
+func (k *Kernel) ExecuteCodeStream(ctx context.Context, code string, handler func(Event)) ([]ResultMessage, []ExceptionMessage, *ReplyMessage, error) {
+	return k.execute(ctx, code, handler, true)
+}
+
+func (k *Kernel) execute(ctx context.Context, code string, handler func(Event), storeHistory bool) ([]ResultMessage, []ExceptionMessage, *ReplyMessage, error) {
 	if len(strings.TrimSpace(code)) == 0 {
-		return []ResultMessage{}, nil, nil
+		return []ResultMessage{}, nil, nil, nil
 	}
 	req := executeRequest{
-		code:      code,
-		messageId: uuid.New().String(),
-		result:    make([]ResultMessage, 0, 1),
-		exception: make([]ExceptionMessage, 0, 1),
-		doneChan:  make(chan struct{}),
+		code:         code,
+		messageId:    uuid.New().String(),
+		storeHistory: storeHistory,
+		outputs: Outputs{
+			Results:    make([]ResultMessage, 0, 1),
+			Exceptions: make([]ExceptionMessage, 0, 1),
+		},
+		doneChan: make(chan struct{}),
+		handler:  handler,
 	}
 	k.mu.Lock()
 	k.codeRequests[req.messageId] = &req
 	k.mu.Unlock()
 
+	start := time.Now()
 	if err := k.sendExecuteRequest(req); err != nil {
-		return nil, nil, err
+		k.removeRequest(req.messageId)
+		return nil, nil, nil, err
+	}
+
+	select {
+	case <-req.doneChan:
+		if req.err != nil {
+			return req.outputs.Results, req.outputs.Exceptions, req.reply, req.err
+		}
+	case <-ctx.Done():
+		k.removeRequest(req.messageId)
+		if err := k.Interrupt(); err != nil {
+			log.Println("interrupting kernel", k.ID, err)
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, nil, nil, newTimeoutError(ctx, start)
+		}
+		return nil, nil, nil, ctx.Err()
 	}
-	<-req.doneChan
 
-	return req.result, req.exception, nil
+	return req.outputs.Results, req.outputs.Exceptions, req.reply, nil
 }
 
-func (k *Kernel) listenToKernel() error {
-	header := http.Header{}
-	if token != "" {
-		header.Add("Authorization", "token "+token)
+func (k *Kernel) removeRequest(messageId string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.codeRequests, messageId)
+}
+
+// finishRequest completes a pending request, unless it was already completed
+// or abandoned.
+func (k *Kernel) finishRequest(messageId string, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	request, ok := k.codeRequests[messageId]
+	if !ok {
+		return
 	}
-	u := url.URL{Scheme: "ws", Host: host, Path: fmt.Sprintf("api/kernels/%s/channels", k.ID)}
+	delete(k.codeRequests, messageId)
+	request.err = err
+	close(request.doneChan)
+}
+
+func (k *Kernel) pendingRequests() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	ids := make([]string, 0, len(k.codeRequests))
+	for id := range k.codeRequests {
+		ids = append(ids, id)
+	}
+	return ids
+}
 
-	u.Query().Add("session_id", k.sessionId)
-	client, resp, err := websocket.DefaultDialer.Dial(u.String(), header)
+func (k *Kernel) dial() (*websocket.Conn, error) {
+	u := k.server.websocketEndpoint("api/kernels", k.ID, "channels")
+	u.RawQuery = url.Values{"session_id": {k.sessionId}}.Encode()
+
+	conn, resp, err := k.server.dialer.Dial(u.String(), k.server.header())
 	if err != nil {
-		_ = err
-		log.Println("connection ", err)
+		if resp != nil {
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode == http.StatusNotFound {
+				err = ErrKernelGone
+			}
+			return nil, fmt.Errorf("connecting to kernel %s: %w, status: %s, resp: %s", k.ID, err, resp.Status, string(body))
+		}
+		return nil, fmt.Errorf("connecting to kernel %s: %w", k.ID, err)
 	}
-	if resp.StatusCode >= 400 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf(resp.Status, string(body))
+	return conn, nil
+}
+
+func (k *Kernel) listenToKernel() error {
+	conn, err := k.dial()
+	if err != nil {
+		return err
 	}
+	k.messageChan = make(chan Message)
+	k.conn = conn
 
-	ch := make(chan Message)
-	k.messageChan = ch
-	k.conn = client
+	go k.readMessages(conn)
+	return nil
+}
 
-	go func() {
-		for {
+func (k *Kernel) readMessages(conn *websocket.Conn) {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
 			select {
 			case <-k.closeChan:
 				return
 			default:
-				var op Message
-				err = client.ReadJSON(&op)
-				k.log("Message type: %s ParentHeader: %s\n", op.MsgType, op.ParentHeader)
-				content, _ := json.Marshal(op.Content)
-				k.log("Content: %s\n", string(content))
-				k.log("--------------------\n\n")
+			}
+			log.Println("kernel", k.ID, "connection dropped:", err)
+			if conn, err = k.reconnect(conn); err != nil {
 				select {
 				case <-k.closeChan:
 					return
 				default:
-					if err != nil {
-						log.Println(err)
-						continue
-					}
-					ch <- op
 				}
+				log.Println("kernel", k.ID, "lost:", err)
+				k.lose(fmt.Errorf("%w: %v", ErrDisconnected, err))
+				return
 			}
+			continue
 		}
-	}()
-	return nil
+
+		var op Message
+		if err := json.Unmarshal(data, &op); err != nil {
+			log.Println("kernel", k.ID, "invalid message:", err)
+			continue
+		}
+		k.log("Message type: %s ParentHeader: %s\n", op.MsgType, op.ParentHeader)
+		content, _ := json.Marshal(op.Content)
+		k.log("Content: %s\n", string(content))
+		k.log("--------------------\n\n")
+		select {
+		case <-k.closeChan:
+			return
+		case k.messageChan <- op:
+		}
+	}
+}
+
+const (
+	reconnectAttempts = 5
+	resyncIdleTimeout = 5 * time.Second
+)
+
+// reconnect dials the kernel again with the same session id, so that the
+// Jupyter server replays the messages it buffered while we were gone.
+func (k *Kernel) reconnect(old *websocket.Conn) (*websocket.Conn, error) {
+	old.Close()
+	pending := k.pendingRequests()
+
+	var err error
+	backoff := 500 * time.Millisecond
+	for attempt := 0; attempt < reconnectAttempts; attempt++ {
+		select {
+		case <-k.closeChan:
+			return nil, errors.New("kernel closed")
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		var conn *websocket.Conn
+		if conn, err = k.dial(); err != nil {
+			if errors.Is(err, ErrKernelGone) {
+				return nil, err
+			}
+			log.Println("kernel", k.ID, "reconnecting:", err)
+			continue
+		}
+		k.writeMu.Lock()
+		k.conn = conn
+		k.writeMu.Unlock()
+		go k.resync(pending)
+		return conn, nil
+	}
+	return nil, err
+}
+
+// resync completes the requests that were pending when the connection
+// dropped, in case the server did not replay their messages. The kernel
+// answers shell requests in order, so a request still missing its
+// execute_reply once a kernel_info_request sent after the reconnect is
+// answered lost it. The idle status is published on IOPub, which is not
+// ordered with the shell channel, so requests that got their reply wait up
+// to resyncIdleTimeout for it.
+func (k *Kernel) resync(pending []string) {
+	if len(pending) == 0 {
+		return
+	}
+	if err := k.Ping(context.Background()); err != nil {
+		return
+	}
+
+	lostErr := fmt.Errorf("%w: outputs may be incomplete", ErrDisconnected)
+	var waiting []*executeRequest
+	k.mu.Lock()
+	for _, id := range pending {
+		request, ok := k.codeRequests[id]
+		if !ok {
+			continue
+		}
+		if request.reply == nil {
+			delete(k.codeRequests, id)
+			request.err = lostErr
+			close(request.doneChan)
+			continue
+		}
+		waiting = append(waiting, request)
+	}
+	k.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), resyncIdleTimeout)
+	defer cancel()
+	for _, request := range waiting {
+		select {
+		case <-request.doneChan:
+		case <-ctx.Done():
+			k.finishRequest(request.messageId, lostErr)
+		case <-k.closeChan:
+			return
+		}
+	}
+}
+
+// lose fails every outstanding and following request after the connection
+// could not be recovered or the kernel died.
+func (k *Kernel) lose(err error) {
+	k.lostOnce.Do(func() {
+		k.lostErr = err
+		close(k.lostChan)
+	})
+
+	for _, id := range k.pendingRequests() {
+		k.finishRequest(id, k.lostErr)
+	}
 }
 
 func (k *Kernel) Close() {
-	defer k.conn.Close()
 	if debug {
 		defer k.file.Close()
 	}
+	close(k.closeChan)
 	if err := k.deleteKernel(); err != nil {
 		log.Println(err)
 	}
-	close(k.closeChan)
+
+	k.writeMu.Lock()
+	defer k.writeMu.Unlock()
+	k.conn.Close()
 }
 
 func (k *Kernel) handleKernelMessages() {
@@ -191,84 +376,203 @@ func (k *Kernel) handleKernelMessages() {
 		case <-k.closeChan:
 			return
 		case msg := <-k.messageChan:
+			if msg.MsgType == Status {
+				state, _ := msg.Content["execution_state"].(string)
+				k.setStatus(state)
+			}
 			k.mu.Lock()
 			request, ok := k.codeRequests[msg.ParentHeader.MsgID]
+			reply, waiting := k.replies[msg.ParentHeader.MsgID]
 			k.mu.Unlock()
+			if waiting && strings.HasSuffix(string(msg.MsgType), "_reply") {
+				select {
+				case reply <- msg:
+				default:
+				}
+			}
 			if !ok {
 				continue
 			}
 			switch msg.MsgType {
 			case Stream:
 				stream := parseStreamMessage(msg.Content)
-				res := ResultMessage{
+				k.addOutput(request, Event{Result: &ResultMessage{
+					Type:   Stream,
 					Stream: stream,
-				}
-				k.mu.Lock()
-				request.result = append(request.result, res)
-				k.mu.Unlock()
-			case ExecuteResult, DisplayData:
-				res := parseResultMessage(msg.Content)
-				k.mu.Lock()
-				request.result = append(request.result, res)
-				k.mu.Unlock()
+				}})
+			case ExecuteResult, DisplayData, UpdateDisplayData:
+				res := parseResultMessage(msg.MsgType, msg.Content)
+				k.addOutput(request, Event{Result: &res})
+			case ClearOutput:
+				k.addOutput(request, Event{Clear: parseClearMessage(msg.Content)})
+			case ExecuteReply:
+				reply := parseReplyMessage(msg.Content)
+				k.complete(request, func() {
+					request.reply = &reply
+					request.publish(Event{Reply: &reply})
+				})
+			case InputRequest:
+				prompt := parseInputPrompt(msg)
+				k.addOutput(request, Event{Input: &prompt})
 			case ExecuteError:
-				k.mu.Lock()
-				request.exception = append(request.exception, parseErrorMessage(msg.Content))
-				k.mu.Unlock()
+				exception := parseErrorMessage(msg.Content)
+				k.addOutput(request, Event{Exception: &exception})
 			case Status:
 				if msg.Content["execution_state"] == "idle" {
-					request.doneChan <- struct{}{}
+					k.complete(request, func() {
+						request.idle = true
+					})
 				}
 			}
 		}
 	}
 }
 
+// addOutput records and publishes an output of a pending request. It holds
+// the lock while publishing, so that no output is published after the
+// request completed.
+func (k *Kernel) addOutput(request *executeRequest, event Event) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.codeRequests[request.messageId] != request {
+		return
+	}
+	if event.Input == nil {
+		request.outputs.Apply(event)
+	}
+	request.publish(event)
+}
+
+// complete applies update to a pending request and completes it once both
+// the execute_reply and the idle status arrived. The shell and the IOPub
+// channel are not ordered with each other, but every output precedes the
+// idle status on IOPub.
+func (k *Kernel) complete(request *executeRequest, update func()) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.codeRequests[request.messageId] != request {
+		return
+	}
+	update()
+	if request.idle && request.reply != nil {
+		delete(k.codeRequests, request.messageId)
+		close(request.doneChan)
+	}
+}
+
+func (req *executeRequest) publish(event Event) {
+	if req.handler != nil {
+		req.handler(event)
+	}
+}
+
 func (k *Kernel) sendExecuteRequest(req executeRequest) error {
+	return k.sendMessage(req.messageId, ExecuteRequest, map[string]interface{}{
+		"code":             req.code,
+		"silent":           false,
+		"store_history":    req.storeHistory,
+		"allow_stdin":      req.handler != nil,
+		"stop_on_error":    true,
+		"user_expressions": map[string]interface{}{},
+	})
+}
+
+// SendInput answers a prompt published by ExecuteCodeStream.
+func (k *Kernel) SendInput(prompt *InputPrompt, value string) error {
+	return k.writeMessage("stdin", uuid.New().String(), InputReply, map[string]interface{}{
+		"value": value,
+	}, prompt.header)
+}
+
+func (k *Kernel) sendMessage(messageId string, msgType MessageType, content map[string]interface{}) error {
+	return k.writeMessage("shell", messageId, msgType, content, map[string]interface{}{})
+}
+
+func (k *Kernel) writeMessage(channel, messageId string, msgType MessageType, content map[string]interface{}, parent any) error {
 	msg := map[string]interface{}{
+		"channel": channel,
 		"header": map[string]interface{}{
-			"msg_id":   req.messageId,
+			"msg_id":   messageId,
 			"username": "",
 			"session":  k.sessionId,
-			"msg_type": "execute_request",
+			"msg_type": msgType,
 			"version":  "5.2",
 			"date":     time.Now().Format(time.RFC3339),
 		},
-		"content": map[string]interface{}{
-			"code":             req.code,
-			"silent":           false,
-			"store_history":    false,
-			"allow_stdin":      false,
-			"stop_on_error":    true,
-			"user_expressions": map[string]interface{}{},
-		},
-		"parent_header": map[string]interface{}{},
+		"content":       content,
+		"parent_header": parent,
 		"metadata":      map[string]interface{}{},
 		"buffers":       []interface{}{},
 	}
 
-	err := k.conn.WriteJSON(msg)
-	if err != nil {
-		return err
+	select {
+	case <-k.lostChan:
+		return k.lostErr
+	default:
 	}
-	return nil
+
+	k.writeMu.Lock()
+	defer k.writeMu.Unlock()
+	return k.conn.WriteJSON(msg)
 }
 
-func (k *Kernel) deleteKernel() error {
-	header := http.Header{}
-	if token != "" {
-		header.Add("Authorization", "token "+token)
+// request sends a shell request and waits for the matching reply.
+func (k *Kernel) request(ctx context.Context, msgType MessageType, content map[string]interface{}) (Message, error) {
+	messageId := uuid.New().String()
+	reply := make(chan Message, 1)
+	k.mu.Lock()
+	k.replies[messageId] = reply
+	k.mu.Unlock()
+	defer func() {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		delete(k.replies, messageId)
+	}()
+
+	if err := k.sendMessage(messageId, msgType, content); err != nil {
+		return Message{}, err
 	}
 
-	kernelUrl := url.URL{Scheme: "http", Host: host, Path: "/api/kernels/" + k.ID}
+	select {
+	case msg := <-reply:
+		return msg, nil
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	case <-k.closeChan:
+		return Message{}, errors.New("kernel closed")
+	case <-k.lostChan:
+		return Message{}, k.lostErr
+	}
+}
 
-	req, err := http.NewRequest("DELETE", kernelUrl.String(), nil)
+// Ping checks that the kernel answers a kernel_info_request.
+func (k *Kernel) Ping(ctx context.Context) error {
+	msg, err := k.request(ctx, KernelInfoRequest, map[string]interface{}{})
 	if err != nil {
 		return err
 	}
+	if status, _ := msg.Content["status"].(string); status != "" && status != "ok" {
+		return fmt.Errorf("kernel info status: %s", status)
+	}
+	return nil
+}
 
-	req.Header = header
-	resp, err := http.DefaultClient.Do(req)
+func (k *Kernel) Interrupt() error {
+	resp, err := k.server.do("POST", k.server.endpoint("api/kernels", k.ID, "interrupt"), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		respBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("resp: %s, status code: %s", string(respBytes), resp.Status)
+	}
+	return nil
+}
+
+func (k *Kernel) deleteKernel() error {
+	resp, err := k.server.do("DELETE", k.server.endpoint("api/kernels", k.ID), nil)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,361 @@
+package kernel
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hvaghani221/autopyter/internal/kernel/kerneltest"
+)
+
+// the delays give the client a chance to complete an execution early
+const reorderDelay = 50 * time.Millisecond
+
+func executeStream(t *testing.T, kernel *Kernel, code string, handler func(Event)) ([]ResultMessage, []ExceptionMessage, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results, exceptions, _, err := kernel.ExecuteCodeStream(ctx, code, handler)
+	return results, exceptions, err
+}
+
+func execute(t *testing.T, kernel *Kernel, code string) ([]ResultMessage, []ExceptionMessage) {
+	t.Helper()
+	results, exceptions, err := executeStream(t, kernel, code, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results, exceptions
+}
+
+func streamTexts(results []ResultMessage) []string {
+	texts := []string{}
+	for _, result := range results {
+		if result.Stream != nil {
+			texts = append(texts, result.Stream.Text)
+		}
+	}
+	return texts
+}
+
+func TestExecuteOrdering(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []kerneltest.Step
+		want  []string
+	}{
+		{
+			name: "reply before idle",
+			steps: []kerneltest.Step{
+				kerneltest.Stream("stdout", "a"),
+				kerneltest.Reply(),
+				kerneltest.Delay(reorderDelay),
+				kerneltest.Stream("stdout", "b"),
+				kerneltest.Idle(),
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "idle before reply",
+			steps: []kerneltest.Step{
+				kerneltest.Stream("stdout", "a"),
+				kerneltest.Idle(),
+				kerneltest.Delay(reorderDelay),
+				kerneltest.Reply(),
+			},
+			want: []string{"a"},
+		},
+		{
+			name: "stream after idle",
+			steps: []kerneltest.Step{
+				kerneltest.Idle(),
+				kerneltest.Delay(reorderDelay),
+				kerneltest.Stream("stdout", "late"),
+				kerneltest.Reply(),
+			},
+			want: []string{"late"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, server := newTestServer(t, "secret", kerneltest.Options{})
+			fake.Script("code", test.steps...)
+			kernel := newTestKernel(t, server)
+
+			results, _ := execute(t, kernel, "code")
+			if texts := streamTexts(results); !reflect.DeepEqual(texts, test.want) {
+				t.Fatalf("got outputs %q, want %q", texts, test.want)
+			}
+		})
+	}
+}
+
+func TestExecuteIgnoresOutputsOfFinishedRequests(t *testing.T) {
+	fake, server := newTestServer(t, "secret", kerneltest.Options{})
+	fake.Script("first",
+		kerneltest.Stream("stdout", "first"),
+		kerneltest.Reply(),
+		kerneltest.Idle(),
+		kerneltest.Stream("stdout", "too late"),
+	)
+	fake.Script("second", kerneltest.Stream("stdout", "second"))
+	kernel := newTestKernel(t, server)
+
+	first, _ := execute(t, kernel, "first")
+	second, _ := execute(t, kernel, "second")
+	if texts := streamTexts(first); !reflect.DeepEqual(texts, []string{"first"}) {
+		t.Fatalf("first got outputs %q", texts)
+	}
+	if texts := streamTexts(second); !reflect.DeepEqual(texts, []string{"second"}) {
+		t.Fatalf("second got outputs %q", texts)
+	}
+}
+
+func TestExecuteClearOutput(t *testing.T) {
+	fake, server := newTestServer(t, "secret", kerneltest.Options{})
+	fake.Script("wait",
+		kerneltest.Stream("stdout", "a"),
+		kerneltest.ClearOutput(true),
+		kerneltest.Stream("stdout", "b"),
+	)
+	fake.Script("clear",
+		kerneltest.Stream("stdout", "a"),
+		kerneltest.ClearOutput(false),
+	)
+	fake.Script("trailing wait",
+		kerneltest.Stream("stdout", "a"),
+		kerneltest.ClearOutput(true),
+	)
+	kernel := newTestKernel(t, server)
+
+	tests := map[string][]string{
+		"wait":          {"b"},
+		"clear":         {},
+		"trailing wait": {"a"},
+	}
+	for code, want := range tests {
+		var resets int
+		results, _, err := executeStream(t, kernel, code, func(event Event) {
+			if event.Clear != nil {
+				resets++
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if texts := streamTexts(results); !reflect.DeepEqual(texts, want) {
+			t.Fatalf("%s: got outputs %q, want %q", code, texts, want)
+		}
+		if resets != 1 {
+			t.Fatalf("%s: handler saw %d clear_output events, want 1", code, resets)
+		}
+	}
+}
+
+func TestExecuteUpdateDisplayData(t *testing.T) {
+	fake, server := newTestServer(t, "secret", kerneltest.Options{})
+	fake.Script("progress",
+		kerneltest.DisplayData(map[string]any{"text/plain": "0%"}, "progress"),
+		kerneltest.DisplayData(map[string]any{"text/plain": "other"}, ""),
+		kerneltest.UpdateDisplayData(map[string]any{"text/plain": "100%"}, "progress"),
+		kerneltest.UpdateDisplayData(map[string]any{"text/plain": "unknown"}, "missing"),
+	)
+	kernel := newTestKernel(t, server)
+
+	results, _ := execute(t, kernel, "progress")
+	var got []any
+	for _, result := range results {
+		got = append(got, result.Data["text/plain"])
+	}
+	if want := []any{"100%", "other"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got outputs %q, want %q", got, want)
+	}
+}
+
+func TestExecuteInput(t *testing.T) {
+	fake, server := newTestServer(t, "secret", kerneltest.Options{})
+	fake.Script("input()",
+		kerneltest.Input("Name: ", false),
+		func(e *kerneltest.Execution) error {
+			if len(e.Inputs) == 0 {
+				return nil
+			}
+			e.Publish("stream", map[string]any{"name": "stdout", "text": "hello " + e.Inputs[0]})
+			return nil
+		},
+	)
+	kernel := newTestKernel(t, server)
+
+	var prompts []string
+	results, _, err := executeStream(t, kernel, "input()", func(event Event) {
+		if event.Input == nil {
+			return
+		}
+		prompts = append(prompts, event.Input.Prompt)
+		if err := kernel.SendInput(event.Input, "world"); err != nil {
+			t.Error(err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(prompts, []string{"Name: "}) {
+		t.Fatalf("got prompts %q", prompts)
+	}
+	if texts := streamTexts(results); !reflect.DeepEqual(texts, []string{"hello world"}) {
+		t.Fatalf("got outputs %q", texts)
+	}
+
+	// without a handler the kernel is told that stdin is not supported
+	_, exceptions := execute(t, kernel, "input()")
+	if len(exceptions) != 1 || exceptions[0].EName != "StdinNotImplementedError" {
+		t.Fatalf("got exceptions %+v, want StdinNotImplementedError", exceptions)
+	}
+}
+
+func TestExecuteReconnect(t *testing.T) {
+	fake, server := newTestServer(t, "secret", kerneltest.Options{})
+	fake.Script("buffered",
+		kerneltest.Stream("stdout", "a"),
+		kerneltest.Disconnect(),
+		kerneltest.Stream("stdout", "b"),
+	)
+	fake.Script("lost",
+		kerneltest.Stream("stdout", "a"),
+		kerneltest.Discard(),
+		kerneltest.Stream("stdout", "b"),
+	)
+	kernel := newTestKernel(t, server)
+
+	// the server replays the messages buffered for the session
+	results, _ := execute(t, kernel, "buffered")
+	if texts := streamTexts(results); !reflect.DeepEqual(texts, []string{"a", "b"}) {
+		t.Fatalf("got outputs %q, want the buffered ones", texts)
+	}
+
+	// the execute_reply was lost, resync fails the request once the kernel
+	// answers a later shell request
+	results, _, err := executeStream(t, kernel, "lost", nil)
+	if !errors.Is(err, ErrDisconnected) {
+		t.Fatalf("got error %v, want %v", err, ErrDisconnected)
+	}
+	if texts := streamTexts(results); !reflect.DeepEqual(texts, []string{"a"}) {
+		t.Fatalf("got outputs %q, want those received before the disconnect", texts)
+	}
+
+	// the kernel stays usable
+	if _, _, err := executeStream(t, kernel, "after", nil); err != nil {
+		t.Fatal(err)
+	}
+	if connections := fake.Kernel(kernel.ID).Connections(); connections != 3 {
+		t.Fatalf("connected %d times, want 3", connections)
+	}
+}
+
+func TestExecuteCancel(t *testing.T) {
+	fake, server := newTestServer(t, "secret", kerneltest.Options{})
+	fake.Script("sleep", kerneltest.Delay(time.Second))
+	kernel := newTestKernel(t, server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(reorderDelay, cancel)
+	if _, _, _, err := kernel.ExecuteCodeStream(ctx, "sleep", nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	if interrupts := fake.Kernel(kernel.ID).Interrupts(); interrupts != 1 {
+		t.Fatalf("interrupted %d times, want 1", interrupts)
+	}
+
+	// the interrupted execution does not leak into the next one
+	if _, exceptions := execute(t, kernel, "after"); len(exceptions) != 0 {
+		t.Fatalf("unexpected exceptions: %+v", exceptions)
+	}
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	fake, server := newTestServer(t, "secret", kerneltest.Options{})
+	fake.Script("sleep", kerneltest.Delay(time.Second))
+	kernel := newTestKernel(t, server)
+
+	timeout := 50 * time.Millisecond
+	ctx, cancel := WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, _, _, err := kernel.ExecuteCodeStream(ctx, "sleep", nil)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Timeout != timeout {
+		t.Fatalf("got error %v, want a timeout after %s", err, timeout)
+	}
+	if interrupts := fake.Kernel(kernel.ID).Interrupts(); interrupts != 1 {
+		t.Fatalf("interrupted %d times, want 1", interrupts)
+	}
+}
+
+func TestExecuteKernelDied(t *testing.T) {
+	fake, server := newTestServer(t, "secret", kerneltest.Options{})
+	fake.Script("crash", kerneltest.Stream("stdout", "a"), kerneltest.Die())
+	kernel := newTestKernel(t, server)
+
+	_, _, err := executeStream(t, kernel, "crash", nil)
+	var died *KernelDiedError
+	if !errors.As(err, &died) || died.Status != "dead" {
+		t.Fatalf("got error %v, want the kernel to have died", err)
+	}
+	if kernel.Alive() {
+		t.Fatal("a dead kernel is alive")
+	}
+
+	// following executions fail right away
+	if _, _, err := executeStream(t, kernel, "after", nil); !errors.As(err, &died) {
+		t.Fatalf("got error %v, want the kernel to have died", err)
+	}
+}
+
+func TestKernelRestarted(t *testing.T) {
+	fake, server := newTestServer(t, "secret", kerneltest.Options{})
+	kernel := newTestKernel(t, server)
+	execute(t, kernel, "a = 1")
+
+	// a restarted kernel lost its namespace, so it is not alive either
+	fake.Kernel(kernel.ID).SetState("restarting")
+	waitFor(t, "the restart", func() bool { return !kernel.Alive() })
+	var died *KernelDiedError
+	if _, _, err := executeStream(t, kernel, "a", nil); !errors.As(err, &died) || died.Status != "restarting" {
+		t.Fatalf("got error %v, want the kernel to have restarted", err)
+	}
+}
+
+func TestExecuteReply(t *testing.T) {
+	fake, server := newTestServer(t, "secret", kerneltest.Options{})
+	fake.Script("%load", kerneltest.Reply(map[string]any{"source": "set_next_input", "text": "print(1)"}))
+	fake.Script("1/0", kerneltest.Error("ZeroDivisionError", "division by zero"))
+	kernel := newTestKernel(t, server)
+
+	// helpers are not counted as executions
+	if err := kernel.RemoveSnapshot("/tmp/missing.pkl"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		code      string
+		status    string
+		count     int
+		nextInput string
+	}{
+		{code: "a = 1", status: "ok", count: 1},
+		{code: "%load", status: "ok", count: 2, nextInput: "print(1)"},
+		{code: "1/0", status: "error", count: 3},
+	}
+	for _, test := range tests {
+		_, _, reply, err := kernel.ExecuteCode(test.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply == nil {
+			t.Fatalf("%s: no execute_reply", test.code)
+		}
+		if reply.Status != test.status || reply.ExecutionCount != test.count || reply.NextInput() != test.nextInput {
+			t.Fatalf("%s: got reply %+v, want status %s, count %d and next input %q", test.code, reply, test.status, test.count, test.nextInput)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package kernel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const DefaultKernelSpec = "python3"
+
+type KernelSpec struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Language    string `json:"language"`
+}
+
+// ListKernelSpecs returns the kernelspecs installed on the Jupyter server
+// sorted by name, together with the name of the server default.
+func ListKernelSpecs() ([]KernelSpec, string, error) {
+	server := DefaultServer()
+	if server == nil {
+		return nil, "", fmt.Errorf("host is not initialized")
+	}
+	return server.ListKernelSpecs()
+}
+
+func (s *Server) ListKernelSpecs() ([]KernelSpec, string, error) {
+	resp, err := s.do("GET", s.endpoint("api/kernelspecs"), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	respBytes, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return nil, "", fmt.Errorf("resp: %s, status code: %s", string(respBytes), resp.Status)
+	}
+
+	var body struct {
+		Default     string `json:"default"`
+		KernelSpecs map[string]struct {
+			Name string `json:"name"`
+			Spec struct {
+				DisplayName string `json:"display_name"`
+				Language    string `json:"language"`
+			} `json:"spec"`
+		} `json:"kernelspecs"`
+	}
+	if err := json.Unmarshal(respBytes, &body); err != nil {
+		return nil, "", err
+	}
+
+	specs := make([]KernelSpec, 0, len(body.KernelSpecs))
+	for name, spec := range body.KernelSpecs {
+		if spec.Name != "" {
+			name = spec.Name
+		}
+		specs = append(specs, KernelSpec{
+			Name:        name,
+			DisplayName: spec.Spec.DisplayName,
+			Language:    spec.Spec.Language,
+		})
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].Name < specs[j].Name
+	})
+	return specs, body.Default, nil
+}
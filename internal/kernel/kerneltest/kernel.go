@@ -0,0 +1,313 @@
+package kerneltest
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+type message = map[string]any
+
+// Kernel is a fake kernel. It handles shell requests one at a time like a
+// real kernel, and buffers the messages sent while no websocket is
+// connected until the next connection.
+type Kernel struct {
+	ID   string
+	Name string
+
+	server   *Server
+	shell    chan message
+	inputs   chan string
+	doneChan chan struct{}
+
+	mu             sync.Mutex
+	conn           *websocket.Conn
+	session        string
+	buffer         []message
+	discard        bool
+	state          string
+	executionCount int
+	history        []string
+	cancel         context.CancelFunc
+	interrupts     int
+	connections    int
+	closed         bool
+}
+
+func newKernel(server *Server, id, name string) *Kernel {
+	k := &Kernel{
+		ID:       id,
+		Name:     name,
+		server:   server,
+		shell:    make(chan message, 64),
+		inputs:   make(chan string, 1),
+		doneChan: make(chan struct{}),
+		state:    "idle",
+	}
+	go k.handleShell()
+	return k
+}
+
+// State returns the execution state reported by GET /api/kernels/{id}.
+func (k *Kernel) State() string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.state
+}
+
+// SetState changes the reported execution state and publishes it on IOPub,
+// e.g. "dead" or "restarting".
+func (k *Kernel) SetState(state string) {
+	k.mu.Lock()
+	k.state = state
+	k.mu.Unlock()
+	k.send(k.message("iopub", "status", message{}, message{"execution_state": state}))
+}
+
+// History returns the code of every execute_request, in the order the
+// kernel ran them.
+func (k *Kernel) History() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]string(nil), k.history...)
+}
+
+// Interrupts returns how often the kernel was interrupted.
+func (k *Kernel) Interrupts() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.interrupts
+}
+
+// Connections returns how often a websocket connected to the kernel.
+func (k *Kernel) Connections() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.connections
+}
+
+// Disconnect closes the websocket, messages are buffered until the client
+// reconnects.
+func (k *Kernel) Disconnect() {
+	k.disconnect(false)
+}
+
+// Discard closes the websocket and drops the messages sent until the client
+// reconnects, like a server that lost its buffer.
+func (k *Kernel) Discard() {
+	k.disconnect(true)
+}
+
+func (k *Kernel) disconnect(discard bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.discard = discard
+	if k.conn != nil {
+		k.conn.Close()
+		k.conn = nil
+	}
+}
+
+func (k *Kernel) model() message {
+	return message{
+		"id":              k.ID,
+		"name":            k.Name,
+		"last_activity":   now(),
+		"execution_state": k.State(),
+		"connections":     k.Connections(),
+	}
+}
+
+func (k *Kernel) connect(conn *websocket.Conn, session string) {
+	k.mu.Lock()
+	if k.closed {
+		k.mu.Unlock()
+		conn.Close()
+		return
+	}
+	if k.conn != nil {
+		k.conn.Close()
+	}
+	// like Jupyter, buffered messages are only replayed to the same session
+	buffer := k.buffer
+	if session != k.session {
+		buffer = nil
+	}
+	k.conn, k.session, k.buffer, k.discard = conn, session, nil, false
+	k.connections++
+	for _, msg := range buffer {
+		if err := conn.WriteJSON(msg); err != nil {
+			break
+		}
+	}
+	k.mu.Unlock()
+
+	for {
+		var msg message
+		if err := conn.ReadJSON(&msg); err != nil {
+			k.mu.Lock()
+			if k.conn == conn {
+				k.conn = nil
+			}
+			k.mu.Unlock()
+			return
+		}
+
+		switch msg["channel"] {
+		case "stdin":
+			content, _ := msg["content"].(map[string]any)
+			value, _ := content["value"].(string)
+			select {
+			case k.inputs <- value:
+			default:
+			}
+		default:
+			select {
+			case k.shell <- msg:
+			case <-k.doneChan:
+				return
+			}
+		}
+	}
+}
+
+func (k *Kernel) send(msg message) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.closed {
+		return
+	}
+	if k.conn != nil && k.conn.WriteJSON(msg) == nil {
+		return
+	}
+	if !k.discard {
+		k.buffer = append(k.buffer, msg)
+	}
+}
+
+func (k *Kernel) message(channel, msgType string, parent message, content message) message {
+	return message{
+		"channel": channel,
+		"header": message{
+			"msg_id":   uuid.New().String(),
+			"msg_type": msgType,
+			"session":  k.ID,
+			"username": "kernel",
+			"version":  "5.3",
+			"date":     now(),
+		},
+		"msg_id":        "",
+		"msg_type":      msgType,
+		"parent_header": parent,
+		"metadata":      message{},
+		"content":       content,
+		"buffers":       []any{},
+	}
+}
+
+func (k *Kernel) interrupt() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.interrupts++
+	if k.cancel != nil {
+		k.cancel()
+	}
+}
+
+func (k *Kernel) shutdown() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.closed {
+		return
+	}
+	k.closed = true
+	k.state = "dead"
+	close(k.doneChan)
+	if k.cancel != nil {
+		k.cancel()
+	}
+	if k.conn != nil {
+		k.conn.Close()
+		k.conn = nil
+	}
+}
+
+func (k *Kernel) handleShell() {
+	for {
+		select {
+		case <-k.doneChan:
+			return
+		case msg := <-k.shell:
+			header, _ := msg["header"].(map[string]any)
+			switch header["msg_type"] {
+			case "execute_request":
+				k.execute(msg)
+			case "kernel_info_request":
+				k.send(k.message("shell", "kernel_info_reply", header, message{
+					"status":           "ok",
+					"protocol_version": "5.3",
+					"implementation":   "kerneltest",
+					"language_info":    message{"name": "python"},
+				}))
+			}
+		}
+	}
+}
+
+func (k *Kernel) execute(msg message) {
+	header, _ := msg["header"].(map[string]any)
+	content, _ := msg["content"].(map[string]any)
+	code, _ := content["code"].(string)
+	allowStdin, _ := content["allow_stdin"].(bool)
+	storeHistory, _ := content["store_history"].(bool)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	k.mu.Lock()
+	// like IPython, only executions stored in the history are counted
+	if storeHistory {
+		k.executionCount++
+	}
+	k.history = append(k.history, code)
+	k.cancel = cancel
+	k.state = "busy"
+	count := k.executionCount
+	k.mu.Unlock()
+
+	execution := &Execution{
+		Code:       code,
+		Count:      count,
+		AllowStdin: allowStdin,
+		ctx:        ctx,
+		kernel:     k,
+		parent:     header,
+		status:     "ok",
+	}
+	execution.Publish("status", message{"execution_state": "busy"})
+	execution.Publish("execute_input", message{"code": code, "execution_count": count})
+
+	for _, step := range k.server.script(code) {
+		if err := step(execution); err != nil {
+			if !errors.Is(err, errDied) {
+				execution.Error("KeyboardInterrupt", "")
+			}
+			break
+		}
+	}
+
+	k.mu.Lock()
+	k.cancel = nil
+	if k.state == "busy" {
+		k.state = "idle"
+	}
+	k.mu.Unlock()
+	if !execution.replied {
+		execution.Reply()
+	}
+	if !execution.idle {
+		execution.Idle()
+	}
+}
@@ -0,0 +1,192 @@
+package kerneltest
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var errDied = errors.New("kernel died")
+
+// Execution is an execute_request running on a fake kernel. Unless a step
+// sent them, the execute_reply and the idle status are sent in this order
+// after the last step.
+type Execution struct {
+	Code       string
+	Count      int
+	AllowStdin bool
+	// Inputs are the values the client answered input requests with.
+	Inputs []string
+
+	ctx     context.Context
+	kernel  *Kernel
+	parent  message
+	status  string
+	replied bool
+	idle    bool
+}
+
+// Publish sends a message on the IOPub channel.
+func (e *Execution) Publish(msgType string, content map[string]any) {
+	e.kernel.send(e.kernel.message("iopub", msgType, e.parent, content))
+}
+
+// Error publishes an exception and makes the execute_reply an error.
+func (e *Execution) Error(ename, evalue string, traceback ...string) {
+	if traceback == nil {
+		traceback = []string{ename + ": " + evalue}
+	}
+	e.status = "error"
+	e.Publish("error", message{"ename": ename, "evalue": evalue, "traceback": traceback})
+}
+
+// Reply sends the execute_reply on the shell channel.
+func (e *Execution) Reply(payload ...map[string]any) {
+	e.replied = true
+	if payload == nil {
+		payload = []map[string]any{}
+	}
+	e.kernel.send(e.kernel.message("shell", "execute_reply", e.parent, message{
+		"status":           e.status,
+		"execution_count":  e.Count,
+		"payload":          payload,
+		"user_expressions": message{},
+	}))
+}
+
+// Idle publishes the idle status.
+func (e *Execution) Idle() {
+	e.idle = true
+	e.Publish("status", message{"execution_state": "idle"})
+}
+
+// Step is one action of a scripted execution. A step returning an error
+// stops the script, the kernel then reports a KeyboardInterrupt.
+type Step func(*Execution) error
+
+func Stream(name, text string) Step {
+	return func(e *Execution) error {
+		e.Publish("stream", message{"name": name, "text": text})
+		return nil
+	}
+}
+
+func ExecuteResult(data map[string]any) Step {
+	return func(e *Execution) error {
+		e.Publish("execute_result", message{"data": data, "metadata": message{}, "execution_count": e.Count})
+		return nil
+	}
+}
+
+// DisplayData publishes display data, a non-empty displayID allows updating
+// it with UpdateDisplayData.
+func DisplayData(data map[string]any, displayID string) Step {
+	return func(e *Execution) error {
+		e.Publish("display_data", displayContent(data, displayID))
+		return nil
+	}
+}
+
+func UpdateDisplayData(data map[string]any, displayID string) Step {
+	return func(e *Execution) error {
+		e.Publish("update_display_data", displayContent(data, displayID))
+		return nil
+	}
+}
+
+func displayContent(data map[string]any, displayID string) message {
+	content := message{"data": data, "metadata": message{}}
+	if displayID != "" {
+		content["transient"] = message{"display_id": displayID}
+	}
+	return content
+}
+
+func ClearOutput(wait bool) Step {
+	return func(e *Execution) error {
+		e.Publish("clear_output", message{"wait": wait})
+		return nil
+	}
+}
+
+func Error(ename, evalue string, traceback ...string) Step {
+	return func(e *Execution) error {
+		e.Error(ename, evalue, traceback...)
+		return nil
+	}
+}
+
+// Delay pauses the execution, an interrupt ends it early.
+func Delay(d time.Duration) Step {
+	return func(e *Execution) error {
+		select {
+		case <-time.After(d):
+			return nil
+		case <-e.ctx.Done():
+			return e.ctx.Err()
+		}
+	}
+}
+
+// Input sends an input_request and waits for the input_reply.
+func Input(prompt string, password bool) Step {
+	return func(e *Execution) error {
+		if !e.AllowStdin {
+			e.Error("StdinNotImplementedError", "raw_input was called, but this frontend does not support input requests.")
+			return nil
+		}
+		e.kernel.send(e.kernel.message("stdin", "input_request", e.parent, message{
+			"prompt":   prompt,
+			"password": password,
+		}))
+		select {
+		case value := <-e.kernel.inputs:
+			e.Inputs = append(e.Inputs, value)
+			return nil
+		case <-e.ctx.Done():
+			return e.ctx.Err()
+		}
+	}
+}
+
+// Disconnect drops the websocket, following messages are buffered.
+func Disconnect() Step {
+	return func(e *Execution) error {
+		e.kernel.Disconnect()
+		return nil
+	}
+}
+
+// Discard drops the websocket and the following messages, until the client
+// reconnects.
+func Discard() Step {
+	return func(e *Execution) error {
+		e.kernel.Discard()
+		return nil
+	}
+}
+
+// Reply sends the execute_reply before the following steps, e.g. to publish
+// outputs or the idle status after it.
+func Reply(payload ...map[string]any) Step {
+	return func(e *Execution) error {
+		e.Reply(payload...)
+		return nil
+	}
+}
+
+func Idle() Step {
+	return func(e *Execution) error {
+		e.Idle()
+		return nil
+	}
+}
+
+// Die reports the kernel as dead and stops the script.
+func Die() Step {
+	return func(e *Execution) error {
+		e.kernel.SetState("dead")
+		e.replied, e.idle = true, true
+		return errDied
+	}
+}
@@ -0,0 +1,342 @@
+// Package kerneltest provides an in-process fake Jupyter server, so that the
+// kernel package and its users can be exercised without a real one:
+//
+//	server := kerneltest.NewServer("token", kerneltest.Options{})
+//	defer server.Close()
+//	server.Script("print(1)", kerneltest.Stream("stdout", "1\n"))
+//	jupyter, _ := kernel.NewServer(kernel.DefaultServerName, server.URL, "token", kernel.ServerOptions{})
+//
+// Code without a script completes without any output.
+package kerneltest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	DefaultKernelSpec = "python3"
+
+	xsrfCookie    = "_xsrf"
+	xsrfHeader    = "X-XSRFToken"
+	sessionCookie = "kerneltest-session"
+)
+
+type Options struct {
+	// BasePath mounts the server below a path, like JupyterHub does for
+	// single-user servers, e.g. "/user/me/".
+	BasePath string
+	// Password enables the login form. Clients logged in with it are
+	// authenticated by a session cookie and have to echo the _xsrf cookie
+	// in the X-XSRFToken header of every request but GET.
+	Password string
+}
+
+type Server struct {
+	// URL includes the base path.
+	URL      string
+	Token    string
+	BasePath string
+
+	password string
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu       sync.Mutex
+	kernels  map[string]*Kernel
+	scripts  map[string][]Step
+	specs    []string
+	sessions map[string]bool
+	logins   int
+}
+
+func NewServer(token string, options Options) *Server {
+	s := &Server{
+		Token:    token,
+		BasePath: "/" + strings.Trim(options.BasePath, "/") + "/",
+		password: options.Password,
+		kernels:  map[string]*Kernel{},
+		scripts:  map[string][]Step{},
+		specs:    []string{DefaultKernelSpec},
+		sessions: map[string]bool{},
+	}
+	if s.BasePath == "//" {
+		s.BasePath = "/"
+	}
+
+	r := mux.NewRouter()
+	r.Methods("GET").Path(s.BasePath + "login").HandlerFunc(s.loginPageHandler)
+	r.Methods("POST").Path(s.BasePath + "login").HandlerFunc(s.loginHandler)
+
+	api := r.PathPrefix(s.BasePath + "api").Subrouter()
+	api.Methods("GET").Path("/kernelspecs").HandlerFunc(s.kernelSpecsHandler)
+	api.Methods("GET").Path("/kernels").HandlerFunc(s.listKernelsHandler)
+	api.Methods("POST").Path("/kernels").HandlerFunc(s.createKernelHandler)
+	api.Methods("GET").Path("/kernels/{ID}").HandlerFunc(s.kernelHandler)
+	api.Methods("DELETE").Path("/kernels/{ID}").HandlerFunc(s.deleteKernelHandler)
+	api.Methods("POST").Path("/kernels/{ID}/interrupt").HandlerFunc(s.interruptHandler)
+	api.Methods("GET").Path("/kernels/{ID}/channels").HandlerFunc(s.channelsHandler)
+	api.Use(s.authenticate)
+
+	s.server = httptest.NewServer(r)
+	s.URL = s.server.URL + s.BasePath
+	return s
+}
+
+func (s *Server) Close() {
+	s.mu.Lock()
+	kernels := make([]*Kernel, 0, len(s.kernels))
+	for _, kernel := range s.kernels {
+		kernels = append(kernels, kernel)
+	}
+	s.kernels = map[string]*Kernel{}
+	s.mu.Unlock()
+
+	for _, kernel := range kernels {
+		kernel.shutdown()
+	}
+	s.server.Close()
+}
+
+// Script makes every kernel run steps when asked to execute code.
+func (s *Server) Script(code string, steps ...Step) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[code] = steps
+}
+
+// SetKernelSpecs replaces the kernelspecs reported by the server, the first
+// one is the default.
+func (s *Server) SetKernelSpecs(specs ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.specs = specs
+}
+
+// Kernels returns the running kernels ordered by id.
+func (s *Server) Kernels() []*Kernel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kernels := make([]*Kernel, 0, len(s.kernels))
+	for _, kernel := range s.kernels {
+		kernels = append(kernels, kernel)
+	}
+	sort.Slice(kernels, func(i, j int) bool {
+		return kernels[i].ID < kernels[j].ID
+	})
+	return kernels
+}
+
+func (s *Server) Kernel(id string) *Kernel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kernels[id]
+}
+
+func (s *Server) script(code string) []Step {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scripts[code]
+}
+
+// Logins returns how often a client logged in successfully.
+func (s *Server) Logins() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Token != "" && r.Header.Get("Authorization") == "token "+s.Token {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if s.Token == "" && s.password == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !s.loggedIn(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Method != "GET" && !validXSRF(r, r.Header.Get(xsrfHeader)) {
+			http.Error(w, "'_xsrf' argument missing from POST", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) loggedIn(r *http.Request) bool {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[cookie.Value]
+}
+
+func validXSRF(r *http.Request, value string) bool {
+	cookie, err := r.Cookie(xsrfCookie)
+	return err == nil && value != "" && cookie.Value == value
+}
+
+func (s *Server) loginPageHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := r.Cookie(xsrfCookie); err != nil {
+		http.SetCookie(w, &http.Cookie{Name: xsrfCookie, Value: uuid.New().String(), Path: s.BasePath})
+	}
+	w.Header().Set("Content-Type", "text/html")
+	_, _ = w.Write([]byte(`<form method="post"><input type="password" name="password"></form>`))
+}
+
+// loginHandler redirects on success and renders the login page again
+// otherwise, like Jupyter.
+func (s *Server) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if !validXSRF(r, r.PostFormValue(xsrfCookie)) {
+		http.Error(w, "'_xsrf' argument missing from POST", http.StatusForbidden)
+		return
+	}
+	if s.password == "" || r.PostFormValue("password") != s.password {
+		s.loginPageHandler(w, r)
+		return
+	}
+
+	session := uuid.New().String()
+	s.mu.Lock()
+	s.sessions[session] = true
+	s.logins++
+	s.mu.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: session, Path: s.BasePath})
+	http.Redirect(w, r, s.BasePath+"tree", http.StatusFound)
+}
+
+func (s *Server) kernelSpecsHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	specs := map[string]any{}
+	for _, name := range s.specs {
+		specs[name] = map[string]any{
+			"name": name,
+			"spec": map[string]any{
+				"display_name": name,
+				"language":     "python",
+			},
+		}
+	}
+	body := map[string]any{"kernelspecs": specs}
+	if len(s.specs) > 0 {
+		body["default"] = s.specs[0]
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (s *Server) listKernelsHandler(w http.ResponseWriter, r *http.Request) {
+	models := []map[string]any{}
+	for _, kernel := range s.Kernels() {
+		models = append(models, kernel.model())
+	}
+	writeJSON(w, http.StatusOK, models)
+}
+
+func (s *Server) createKernelHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Name == "" {
+		body.Name = DefaultKernelSpec
+	}
+
+	s.mu.Lock()
+	known := false
+	for _, spec := range s.specs {
+		known = known || spec == body.Name
+	}
+	if !known {
+		s.mu.Unlock()
+		http.Error(w, "No such kernel named "+body.Name, http.StatusInternalServerError)
+		return
+	}
+	kernel := newKernel(s, uuid.New().String(), body.Name)
+	s.kernels[kernel.ID] = kernel
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusCreated, kernel.model())
+}
+
+func (s *Server) lookup(w http.ResponseWriter, r *http.Request) (*Kernel, bool) {
+	kernel := s.Kernel(mux.Vars(r)["ID"])
+	if kernel == nil {
+		http.Error(w, "Kernel does not exist", http.StatusNotFound)
+		return nil, false
+	}
+	return kernel, true
+}
+
+func (s *Server) kernelHandler(w http.ResponseWriter, r *http.Request) {
+	kernel, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, kernel.model())
+}
+
+func (s *Server) deleteKernelHandler(w http.ResponseWriter, r *http.Request) {
+	kernel, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	delete(s.kernels, kernel.ID)
+	s.mu.Unlock()
+
+	kernel.shutdown()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) interruptHandler(w http.ResponseWriter, r *http.Request) {
+	kernel, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	kernel.interrupt()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) channelsHandler(w http.ResponseWriter, r *http.Request) {
+	kernel, ok := s.lookup(w, r)
+	if !ok {
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	kernel.connect(conn, r.URL.Query().Get("session_id"))
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
@@ -17,6 +17,15 @@ const (
 	Stream         MessageType = "stream"
 	DisplayData    MessageType = "display_data"
 	Status         MessageType = "status"
+
+	ClearOutput       MessageType = "clear_output"
+	UpdateDisplayData MessageType = "update_display_data"
+
+	KernelInfoRequest MessageType = "kernel_info_request"
+	KernelInfoReply   MessageType = "kernel_info_reply"
+
+	InputRequest MessageType = "input_request"
+	InputReply   MessageType = "input_reply"
 )
 
 type Message struct {
@@ -42,21 +51,71 @@ type Header struct {
 type executeRequest struct {
 	code      string
 	messageId string
-	result    []ResultMessage
-	exception []ExceptionMessage
-	doneChan  chan struct{}
+	// storeHistory makes the kernel count the execution, like a notebook
+	// cell, instead of a hidden helper.
+	storeHistory bool
+	outputs      Outputs
+	reply        *ReplyMessage
+	idle         bool
+	doneChan     chan struct{}
+	handler      func(Event)
+	err          error
+}
+
+type Event struct {
+	Result    *ResultMessage
+	Exception *ExceptionMessage
+	Input     *InputPrompt
+	Clear     *ClearMessage
+	Reply     *ReplyMessage
+}
+
+// ReplyMessage is the execute_reply of the shell channel.
+type ReplyMessage struct {
+	// Status is ok, error or aborted.
+	Status         string           `json:"status"`
+	ExecutionCount int              `json:"execution_count"`
+	Payload        []map[string]any `json:"payload,omitempty"`
+}
+
+// NextInput returns the text of a set_next_input payload, e.g. from %load.
+func (r *ReplyMessage) NextInput() string {
+	for _, payload := range r.Payload {
+		if payload["source"] == "set_next_input" {
+			text, _ := payload["text"].(string)
+			return text
+		}
+	}
+	return ""
+}
+
+type ClearMessage struct {
+	// Wait defers clearing until the next output arrives.
+	Wait bool
+}
+
+// InputPrompt is an input() or getpass() call waiting for Kernel.SendInput.
+type InputPrompt struct {
+	Prompt   string
+	Password bool
+	header   Header
 }
 
 type ExceptionMessage struct {
 	EName     string `json:"ename"`
 	EValue    string `json:"evalue"`
 	Traceback string `json:"traceback"`
+	// RawTraceback is the traceback as sent by the kernel, with ANSI colors.
+	RawTraceback []string `json:"raw_traceback,omitempty"`
 }
 
 type ResultMessage struct {
+	Type     MessageType
 	Data     map[string]any
 	MetaData map[string]any
 	Stream   *StreamMessage
+	// DisplayID identifies display data that update_display_data replaces.
+	DisplayID string `json:",omitempty"`
 }
 
 type StreamMessage struct {
@@ -64,26 +123,65 @@ type StreamMessage struct {
 	Text string
 }
 
+func parseInputPrompt(msg Message) InputPrompt {
+	prompt, _ := msg.Content["prompt"].(string)
+	password, _ := msg.Content["password"].(bool)
+	return InputPrompt{
+		Prompt:   prompt,
+		Password: password,
+		header:   msg.Header,
+	}
+}
+
 func parseErrorMessage(msg map[string]any) ExceptionMessage {
 	trace := msg["traceback"].([]any)
+	raw := make([]string, 0, len(trace))
 	builder := strings.Builder{}
 	for _, t := range trace {
+		raw = append(raw, t.(string))
 		builder.Write(ansihtml.ConvertToHTML([]byte(t.(string))))
 		builder.WriteString("\n")
 	}
 
 	return ExceptionMessage{
-		EName:     msg["ename"].(string),
-		EValue:    msg["evalue"].(string),
-		Traceback: builder.String(),
+		EName:        msg["ename"].(string),
+		EValue:       msg["evalue"].(string),
+		Traceback:    builder.String(),
+		RawTraceback: raw,
 	}
 }
 
-func parseResultMessage(msg map[string]any) ResultMessage {
-	return ResultMessage{
+func parseResultMessage(msgType MessageType, msg map[string]any) ResultMessage {
+	res := ResultMessage{
+		Type:     msgType,
 		Data:     msg["data"].(map[string]any),
 		MetaData: msg["metadata"].(map[string]any),
 	}
+	if transient, ok := msg["transient"].(map[string]any); ok {
+		res.DisplayID, _ = transient["display_id"].(string)
+	}
+	return res
+}
+
+func parseReplyMessage(msg map[string]any) ReplyMessage {
+	reply := ReplyMessage{}
+	reply.Status, _ = msg["status"].(string)
+	if count, ok := msg["execution_count"].(float64); ok {
+		reply.ExecutionCount = int(count)
+	}
+	if payload, ok := msg["payload"].([]any); ok {
+		for _, p := range payload {
+			if p, ok := p.(map[string]any); ok {
+				reply.Payload = append(reply.Payload, p)
+			}
+		}
+	}
+	return reply
+}
+
+func parseClearMessage(msg map[string]any) *ClearMessage {
+	wait, _ := msg["wait"].(bool)
+	return &ClearMessage{Wait: wait}
 }
 
 func parseStreamMessage(msg map[string]any) *StreamMessage {
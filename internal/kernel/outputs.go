@@ -0,0 +1,55 @@
+package kernel
+
+// Outputs collects the outputs of an execution the way a notebook frontend
+// does, honoring clear_output and update_display_data.
+type Outputs struct {
+	Results    []ResultMessage
+	Exceptions []ExceptionMessage
+	// clearPending is set by clear_output with wait until the next output.
+	clearPending bool
+}
+
+// Apply adds event to the outputs and reports whether outputs collected
+// before were changed or removed.
+func (o *Outputs) Apply(event Event) bool {
+	switch {
+	case event.Clear != nil:
+		if event.Clear.Wait {
+			o.clearPending = true
+			return false
+		}
+		o.clear()
+		return true
+	case event.Result != nil && event.Result.Type == UpdateDisplayData:
+		updated := false
+		for i := range o.Results {
+			if event.Result.DisplayID != "" && o.Results[i].DisplayID == event.Result.DisplayID {
+				o.Results[i].Data = event.Result.Data
+				o.Results[i].MetaData = event.Result.MetaData
+				updated = true
+			}
+		}
+		return updated
+	case event.Result != nil:
+		reset := o.clearPending
+		if reset {
+			o.clear()
+		}
+		o.Results = append(o.Results, *event.Result)
+		return reset
+	case event.Exception != nil:
+		reset := o.clearPending
+		if reset {
+			o.clear()
+		}
+		o.Exceptions = append(o.Exceptions, *event.Exception)
+		return reset
+	}
+	return false
+}
+
+func (o *Outputs) clear() {
+	o.Results = nil
+	o.Exceptions = nil
+	o.clearPending = false
+}
@@ -1,90 +1,675 @@
 package kernel
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type PoolConfig struct {
+	// MinSize is the number of warm kernels the pool keeps ready.
+	MinSize int
+	// MaxSize bounds the number of kernels the pool holds or starts,
+	// including the base kernel and kernels still starting for a previous
+	// checkpoint. The base kernel is started even when the bound is reached.
+	MaxSize int
+	// MaxIdle replaces kernels that stayed unused for longer, 0 disables it.
+	MaxIdle time.Duration
+	// CheckInterval is how often idle kernels are health checked.
+	CheckInterval time.Duration
+	// Snapshot starts warm kernels from a dill snapshot of the base kernel
+	// instead of replaying the cells, replaying is still used whenever the
+	// snapshot cannot be taken or restored.
+	Snapshot bool
+}
+
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		MinSize:       4,
+		MaxSize:       8,
+		CheckInterval: 30 * time.Second,
+	}
+}
+
+type PoolStats struct {
+	Ready     int    `json:"ready"`
+	Starting  int    `json:"starting"`
+	Total     int    `json:"total"`
+	MinSize   int    `json:"min_size"`
+	MaxSize   int    `json:"max_size"`
+	Created   int    `json:"created"`
+	Reaped    int    `json:"reaped"`
+	Unhealthy int    `json:"unhealthy"`
+	Failed    int    `json:"failed"`
+	LastError string `json:"last_error,omitempty"`
+	Base      bool   `json:"base"`
+}
+
+const (
+	replayAttempts   = 5
+	replayBackoff    = 500 * time.Millisecond
+	replayMaxBackoff = 30 * time.Second
 )
 
+type idleKernel struct {
+	kernel *Kernel
+	since  time.Time
+}
+
 type PreloadedKernels struct {
-	code    string
-	kernels []*Kernel
-	mu      sync.Mutex
+	target  Target
+	cells   []string
+	kernels []idleKernel
+	// base is kept at the latest checkpoint and never handed out while
+	// warm kernels are available, so that appending a cell does not
+	// require a full replay.
+	base         *Kernel
+	baseStarting bool
+	// snapshot is the path of the snapshot of the base kernel, warm kernels
+	// wait for it while snapshotPending is set.
+	snapshot        string
+	snapshotPending bool
+	// stale are the snapshots of previous checkpoints, removed once the
+	// next base kernel is ready.
+	stale          []string
+	snapshotPrefix string
+	config         PoolConfig
+	generation     int
+	// starting counts the kernels starting for the current checkpoint,
+	// pending every kernel being started or advanced.
+	starting  int
+	pending   int
+	stats     PoolStats
+	replayErr *ReplayError
+	onChange  func()
+	closeChan chan struct{}
+	mu        sync.Mutex
 }
 
-func NewPreloaded() (*PreloadedKernels, error) {
-	kernels := &PreloadedKernels{}
-	if err := kernels.Reset(""); err != nil {
+func NewPreloaded(target Target, cells []string, config PoolConfig) (*PreloadedKernels, error) {
+	if target.Server == nil {
+		return nil, fmt.Errorf("host is not initialized")
+	}
+	if config.MaxSize < 1 {
+		config.MaxSize = 1
+	}
+	if config.MinSize < 0 {
+		config.MinSize = 0
+	}
+	if config.MinSize > config.MaxSize {
+		config.MinSize = config.MaxSize
+	}
+	kernels := &PreloadedKernels{
+		target:         target,
+		config:         config,
+		closeChan:      make(chan struct{}),
+		snapshotPrefix: "/tmp/autopyter-" + uuid.New().String(),
+	}
+	if err := kernels.Reset(cells); err != nil {
 		return nil, err
 	}
+	if config.CheckInterval > 0 {
+		go kernels.reap()
+	}
 	return kernels, nil
 }
 
-func (k *PreloadedKernels) Get() (*Kernel, error) {
+// Get hands out a warm kernel. When a selected cell raises on replay, Get
+// refuses to hand out kernels unless allowBroken is set, in which case the
+// kernel is replayed ignoring the exceptions.
+func (k *PreloadedKernels) Get(allowBroken bool) (*Kernel, error) {
 	k.mu.Lock()
 	defer k.mu.Unlock()
 
-	if len(k.kernels) == 0 {
-		return k.createPreloadedKernel()
+	broken := k.replayErr != nil && k.replayErr.Exception != nil
+	if broken && !allowBroken {
+		return nil, k.replayErr
 	}
-	kernel := k.kernels[len(k.kernels)-1]
-	k.kernels = k.kernels[:len(k.kernels)-1]
 
-	if len(k.kernels) == 0 {
-		go func() {
-			preloadedkernel, err := k.createPreloadedKernel()
-			if err != nil {
-				log.Println("Error creating preloaded kernel:", err)
-				return
-			}
-			k.mu.Lock()
-			defer k.mu.Unlock()
-			k.kernels = append(k.kernels, preloadedkernel)
-		}()
+	k.pruneDead()
+	if len(k.kernels) == 0 && !broken && k.base != nil {
+		kernel := k.base
+		k.base = nil
+		k.startBase()
+		k.fill()
+		return kernel, nil
 	}
 
+	if len(k.kernels) == 0 || broken {
+		cells, generation := k.cells, k.generation
+		k.mu.Unlock()
+		kernel, err := k.createPreloadedKernel(cells, broken)
+		k.mu.Lock()
+		if err != nil {
+			k.stats.Failed++
+			k.setError(generation, err)
+			return nil, err
+		}
+		k.stats.Created++
+		if !broken {
+			k.fill()
+		}
+		return kernel, nil
+	}
+	kernel := k.kernels[len(k.kernels)-1].kernel
+	k.kernels = k.kernels[:len(k.kernels)-1]
+
+	k.fill()
 	return kernel, nil
 }
 
-func (k *PreloadedKernels) Reset(code string) error {
+func (k *PreloadedKernels) Reset(cells []string) error {
 	k.mu.Lock()
-	k.code = code
-	for _, kernel := range k.kernels {
-		go kernel.Close()
+	defer k.mu.Unlock()
+
+	k.cells = cells
+	k.generation++
+	k.setError(k.generation, nil)
+	for _, idle := range k.kernels {
+		go idle.kernel.Close()
 	}
 	k.kernels = k.kernels[:0]
-	k.mu.Unlock()
+	k.starting = 0
+	if k.base != nil {
+		go k.base.Close()
+		k.base = nil
+	}
+	k.baseStarting = false
+	k.invalidateSnapshot()
+
+	k.startBase()
+	k.fill()
+	return nil
+}
+
+// Append moves the pool to a checkpoint extending the current one by cell.
+// Warm kernels and the base kernel only execute the new cell instead of
+// replaying every cell from scratch.
+func (k *PreloadedKernels) Append(cell string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	cells := make([]string, len(k.cells), len(k.cells)+1)
+	copy(cells, k.cells)
+	cells = append(cells, cell)
+	k.cells = cells
+	k.generation++
+	k.setError(k.generation, nil)
+
+	idle := k.kernels
+	k.kernels = nil
+	k.starting = 0
+	k.invalidateSnapshot()
+	for _, candidate := range idle {
+		if k.config.Snapshot {
+			// warm kernels restart from the new snapshot, so they start
+			// from exactly the same state as the base
+			go candidate.kernel.Close()
+			continue
+		}
+		k.starting++
+		k.pending++
+		go k.advance(candidate.kernel, false, len(cells)-1, cell, k.generation)
+	}
+
+	if k.base != nil {
+		k.baseStarting = true
+		k.pending++
+		go k.advance(k.base, true, len(cells)-1, cell, k.generation)
+		k.base = nil
+	} else {
+		k.baseStarting = false
+		k.startBase()
+	}
+	k.fill()
+	return nil
+}
+
+// advance executes code, the cell at index cell, on a kernel that already
+// replayed all the cells before it. The cells may change meanwhile, so the
+// code is passed in instead of being read from them.
+func (k *PreloadedKernels) advance(kernel *Kernel, base bool, cell int, code string, generation int) {
+	_, exceptions, _, err := kernel.ExecuteCode(code)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pending--
+	if generation != k.generation {
+		go kernel.Close()
+		k.fill()
+		return
+	}
+	if base {
+		k.baseStarting = false
+	} else {
+		k.starting--
+	}
+
+	if err != nil || len(exceptions) > 0 {
+		go kernel.Close()
+		replayErr := &ReplayError{Cell: cell, Err: err}
+		if len(exceptions) > 0 {
+			replayErr.Exception = &exceptions[0]
+		}
+		log.Println("Error advancing preloaded kernel:", replayErr)
+		k.stats.Failed++
+		k.setError(generation, replayErr)
+		if base {
+			k.snapshotPending = false
+		}
+		if replayErr.Exception == nil {
+			if base {
+				k.startBase()
+			}
+			k.fill()
+		}
+		return
+	}
+
+	if base {
+		k.setBase(kernel, generation)
+		return
+	}
+	k.kernels = append(k.kernels, idleKernel{kernel: kernel, since: time.Now()})
+}
+
+// invalidateSnapshot drops the snapshot of the previous checkpoint, so that
+// no kernel is restored from it, and makes warm kernels wait for the
+// snapshot of the new one in snapshot mode. It must be called with the lock
+// held.
+func (k *PreloadedKernels) invalidateSnapshot() {
+	if k.snapshot != "" {
+		k.stale = append(k.stale, k.snapshot)
+		k.snapshot = ""
+	}
+	k.snapshotPending = k.config.Snapshot
+}
+
+// startBase replays the cells on a new base kernel, it must be called with
+// the lock held.
+func (k *PreloadedKernels) startBase() {
+	if k.baseStarting {
+		return
+	}
+	k.baseStarting = true
+	k.pending++
+	cells, generation := k.cells, k.generation
+	go func() {
+		kernel, err := k.createPreloadedKernel(cells, false)
+
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		k.pending--
+		if generation != k.generation {
+			if err == nil {
+				go kernel.Close()
+			}
+			k.fill()
+			return
+		}
+		k.baseStarting = false
+		if err != nil {
+			log.Println("Error creating base kernel:", err)
+			k.stats.Failed++
+			k.setError(generation, err)
+			k.snapshotPending = false
+			k.fill()
+			return
+		}
+		k.stats.Created++
+		k.setBase(kernel, generation)
+	}()
+}
+
+// setBase stores the base kernel and snapshots it in snapshot mode, it must
+// be called with the lock held. A kernel being snapshotted only becomes the
+// base once the snapshot is done, so that Get never hands it out while the
+// snapshot helpers still run on it.
+func (k *PreloadedKernels) setBase(kernel *Kernel, generation int) {
+	if !k.config.Snapshot || !k.snapshotPending {
+		k.base = kernel
+		return
+	}
+
+	k.baseStarting = true
+	k.pending++
+	stale := k.stale
+	k.stale = nil
+	path := fmt.Sprintf("%s-%d.pkl", k.snapshotPrefix, generation)
+	go func() {
+		err := kernel.Snapshot(path)
+		if err != nil {
+			log.Println("Error taking snapshot, falling back to replay:", err)
+		}
+		for _, previous := range stale {
+			if err := kernel.RemoveSnapshot(previous); err != nil {
+				log.Println("Error removing snapshot:", err)
+			}
+		}
+
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		k.pending--
+		if generation != k.generation {
+			go func() {
+				if err == nil {
+					if err := kernel.RemoveSnapshot(path); err != nil {
+						log.Println("Error removing snapshot:", err)
+					}
+				}
+				kernel.Close()
+			}()
+			k.fill()
+			return
+		}
+		k.baseStarting = false
+		k.base = kernel
+		k.snapshotPending = false
+		k.snapshot = ""
+		if err == nil {
+			k.snapshot = path
+		}
+		k.fill()
+	}()
+}
 
-	for i := 0; i < 4; i++ {
-		go func() {
-			preloadedkernel, err := k.createPreloadedKernel()
-			if err != nil {
-				log.Println("Error creating preloaded kernel:", err)
-				return
+// OnStatusChange registers a function called whenever the replay error
+// reported by ReplayError changes.
+func (k *PreloadedKernels) OnStatusChange(f func()) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.onChange = f
+}
+
+// ReplayError returns the error that prevents the previously selected
+// cells from being replayed, or nil when the pool is healthy.
+func (k *PreloadedKernels) ReplayError() *ReplayError {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.replayErr
+}
+
+// setError records the outcome of the latest kernel start, it must be
+// called with the lock held.
+func (k *PreloadedKernels) setError(generation int, err error) {
+	if generation != k.generation {
+		return
+	}
+	if err != nil {
+		k.stats.LastError = err.Error()
+	}
+
+	var replayErr *ReplayError
+	if !errors.As(err, &replayErr) {
+		replayErr = nil
+	}
+	if replayErr == k.replayErr {
+		return
+	}
+	k.replayErr = replayErr
+	if k.onChange != nil {
+		go k.onChange()
+	}
+}
+
+func (k *PreloadedKernels) Stats() PoolStats {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	stats := k.stats
+	stats.Ready = len(k.kernels)
+	stats.Starting = k.starting
+	stats.Total = k.size()
+	stats.MinSize = k.config.MinSize
+	stats.MaxSize = k.config.MaxSize
+	stats.Base = k.base != nil
+	return stats
+}
+
+// fill starts kernels until MinSize kernels are ready or starting, or the
+// pool reached MaxSize. It must be called with the lock held.
+func (k *PreloadedKernels) fill() {
+	select {
+	case <-k.closeChan:
+		return
+	default:
+	}
+	if k.snapshotPending {
+		return
+	}
+	for len(k.kernels)+k.starting < k.config.MinSize && k.size() < k.config.MaxSize {
+		k.starting++
+		k.pending++
+		go k.startKernel(k.cells, k.snapshot, k.generation)
+	}
+}
+
+// size returns the number of kernels held or being started, it must be
+// called with the lock held.
+func (k *PreloadedKernels) size() int {
+	size := len(k.kernels) + k.pending
+	if k.base != nil {
+		size++
+	}
+	return size
+}
+
+func (k *PreloadedKernels) startKernel(cells []string, snapshot string, generation int) {
+	backoff := replayBackoff
+	for attempt := 1; ; attempt++ {
+		var preloadedkernel *Kernel
+		var err error
+		if snapshot != "" {
+			preloadedkernel, err = k.restoreKernel(cells, snapshot)
+		} else {
+			preloadedkernel, err = k.createPreloadedKernel(cells, false)
+		}
+
+		k.mu.Lock()
+		if generation != k.generation {
+			k.pending--
+			k.fill()
+			k.mu.Unlock()
+			if err == nil {
+				go preloadedkernel.Close()
 			}
+			return
+		}
+		if err == nil {
+			k.pending--
+			k.starting--
+			k.stats.Created++
+			// a kernel restored from the snapshot did not run the cells,
+			// so it cannot tell that a cell raising on replay was fixed
+			if snapshot == "" || k.replayErr == nil || k.replayErr.Exception == nil {
+				k.setError(generation, nil)
+			}
+			k.kernels = append(k.kernels, idleKernel{kernel: preloadedkernel, since: time.Now()})
+			k.mu.Unlock()
+			return
+		}
+
+		log.Println("Error creating preloaded kernel:", err)
+		k.stats.Failed++
+		// an exception raised by a cell fails the same way on every retry
+		var replayErr *ReplayError
+		if attempt == replayAttempts || (errors.As(err, &replayErr) && replayErr.Exception != nil) {
+			k.pending--
+			k.starting--
+			k.setError(generation, err)
+			k.mu.Unlock()
+			return
+		}
+		k.mu.Unlock()
+
+		select {
+		case <-k.closeChan:
 			k.mu.Lock()
-			defer k.mu.Unlock()
-			k.kernels = append(k.kernels, preloadedkernel)
-		}()
+			k.pending--
+			k.mu.Unlock()
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > replayMaxBackoff {
+			backoff = replayMaxBackoff
+		}
 	}
-	return nil
 }
 
-func (k *PreloadedKernels) createPreloadedKernel() (*Kernel, error) {
-	preloadedkernel, err := CreateKernel()
+// restoreKernel starts a kernel from the snapshot of the base kernel and
+// falls back to replaying the cells when restoring fails.
+func (k *PreloadedKernels) restoreKernel(cells []string, snapshot string) (*Kernel, error) {
+	preloadedkernel, err := k.target.Server.CreateKernel(k.target.Spec)
 	if err != nil {
 		return nil, err
 	}
-	if msg, exception, err := preloadedkernel.ExecuteCode(k.code); err != nil {
-		log.Println(msg, exception, err)
-		return nil, err
+	if err := preloadedkernel.Restore(snapshot, len(cells)); err != nil {
+		log.Println("Error restoring snapshot, falling back to replay:", err)
+		preloadedkernel.Close()
+		return k.createPreloadedKernel(cells, false)
 	}
 	return preloadedkernel, nil
 }
 
-func (k *PreloadedKernels) Close() {
+func (k *PreloadedKernels) createPreloadedKernel(cells []string, ignoreExceptions bool) (*Kernel, error) {
+	return ReplayKernel(k.target, cells, ignoreExceptions)
+}
+
+// ReplayKernel starts a kernel of target outside of any pool and executes
+// cells on it. The first cell raising an exception fails it with a
+// ReplayError unless ignoreExceptions is set.
+func ReplayKernel(target Target, cells []string, ignoreExceptions bool) (*Kernel, error) {
+	kernel, err := target.Server.CreateKernel(target.Spec)
+	if err != nil {
+		return nil, err
+	}
+	for i, cell := range cells {
+		_, exceptions, _, err := kernel.ExecuteCode(cell)
+		if err != nil {
+			kernel.Close()
+			return nil, &ReplayError{Cell: i, Err: err}
+		}
+		if len(exceptions) > 0 && !ignoreExceptions {
+			kernel.Close()
+			return nil, &ReplayError{Cell: i, Exception: &exceptions[0]}
+		}
+	}
+	return kernel, nil
+}
+
+func (k *PreloadedKernels) reap() {
+	ticker := time.NewTicker(k.config.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-k.closeChan:
+			return
+		case <-ticker.C:
+			k.checkIdleKernels()
+		}
+	}
+}
+
+// checkIdleKernels replaces idle kernels that are too old or do not answer
+// a kernel_info_request.
+func (k *PreloadedKernels) checkIdleKernels() {
+	k.mu.Lock()
+	idle := make([]idleKernel, len(k.kernels))
+	copy(idle, k.kernels)
+	k.mu.Unlock()
+
+	expired := make(map[*Kernel]bool)
+	unhealthy := make(map[*Kernel]bool)
+	for _, candidate := range idle {
+		if !candidate.kernel.Alive() {
+			unhealthy[candidate.kernel] = true
+			continue
+		}
+		if k.config.MaxIdle > 0 && time.Since(candidate.since) > k.config.MaxIdle {
+			expired[candidate.kernel] = true
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := candidate.kernel.Ping(ctx); err != nil {
+			log.Println("Preloaded kernel", candidate.kernel.ID, "is unhealthy:", err)
+			unhealthy[candidate.kernel] = true
+		}
+		cancel()
+	}
+	if len(expired) == 0 && len(unhealthy) == 0 {
+		return
+	}
+
 	k.mu.Lock()
 	defer k.mu.Unlock()
-	for _, kernel := range k.kernels {
-		kernel.Close()
+	kernels := k.kernels[:0]
+	for _, candidate := range k.kernels {
+		switch {
+		case expired[candidate.kernel]:
+			k.stats.Reaped++
+			go candidate.kernel.Close()
+		case unhealthy[candidate.kernel]:
+			k.stats.Unhealthy++
+			go candidate.kernel.Close()
+		default:
+			kernels = append(kernels, candidate)
+		}
+	}
+	k.kernels = kernels
+	k.fill()
+}
+
+// pruneDead drops warm kernels found dead by their heartbeat, it must be
+// called with the lock held.
+func (k *PreloadedKernels) pruneDead() {
+	kernels := k.kernels[:0]
+	for _, candidate := range k.kernels {
+		if candidate.kernel.Alive() {
+			kernels = append(kernels, candidate)
+			continue
+		}
+		k.stats.Unhealthy++
+		go candidate.kernel.Close()
+	}
+	k.kernels = kernels
+	if k.base != nil && !k.base.Alive() {
+		k.stats.Unhealthy++
+		go k.base.Close()
+		k.base = nil
+		k.startBase()
+	}
+}
+
+// Close shuts down every kernel of the pool. The kernels are closed after
+// releasing the lock, so a kernel that hangs does not block other calls.
+func (k *PreloadedKernels) Close() {
+	k.mu.Lock()
+	close(k.closeChan)
+	k.generation++
+	idle, base := k.kernels, k.base
+	snapshots := k.stale
+	if k.snapshot != "" {
+		snapshots = append(snapshots, k.snapshot)
+	}
+	k.kernels, k.base, k.snapshot, k.stale = nil, nil, "", nil
+	k.mu.Unlock()
+
+	for _, candidate := range idle {
+		candidate.kernel.Close()
+	}
+	if base != nil {
+		for _, snapshot := range snapshots {
+			if err := base.RemoveSnapshot(snapshot); err != nil {
+				log.Println("Error removing snapshot:", err)
+			}
+		}
+		base.Close()
 	}
 }
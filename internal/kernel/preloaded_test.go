@@ -0,0 +1,171 @@
+package kernel
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hvaghani221/autopyter/internal/kernel/kerneltest"
+)
+
+func newTestPool(t *testing.T, cells ...string) (*kerneltest.Server, *PreloadedKernels) {
+	t.Helper()
+	return newTestPoolConfig(t, PoolConfig{MinSize: 1, MaxSize: 3}, cells...)
+}
+
+func newTestPoolConfig(t *testing.T, config PoolConfig, cells ...string) (*kerneltest.Server, *PreloadedKernels) {
+	t.Helper()
+	fake, server := newTestServer(t, "secret", kerneltest.Options{})
+	pool, err := NewPreloaded(Target{Server: server, Spec: kerneltest.DefaultKernelSpec}, cells, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return fake, pool
+}
+
+// getReplayed hands out a kernel of pool and checks it ran exactly cells.
+func getReplayed(t *testing.T, fake *kerneltest.Server, pool *PreloadedKernels, allowBroken bool, cells ...string) {
+	t.Helper()
+	kernel, err := pool.Get(allowBroken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kernel.Close()
+
+	if history := fake.Kernel(kernel.ID).History(); !reflect.DeepEqual(history, cells) {
+		t.Fatalf("kernel ran %q, want %q", history, cells)
+	}
+}
+
+func TestPreloadedKernels(t *testing.T) {
+	fake, pool := newTestPool(t, "a = 1")
+	getReplayed(t, fake, pool, false, "a = 1")
+
+	if err := pool.Append("b = 2"); err != nil {
+		t.Fatal(err)
+	}
+	getReplayed(t, fake, pool, false, "a = 1", "b = 2")
+	getReplayed(t, fake, pool, false, "a = 1", "b = 2")
+
+	if err := pool.Reset([]string{"c = 3"}); err != nil {
+		t.Fatal(err)
+	}
+	getReplayed(t, fake, pool, false, "c = 3")
+}
+
+func TestPreloadedKernelsBroken(t *testing.T) {
+	fake, pool := newTestPool(t)
+	fake.Script("raise", kerneltest.Error("ValueError", "boom"))
+
+	if err := pool.Reset([]string{"a = 1", "raise"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := pool.Get(false)
+	var replayErr *ReplayError
+	if !errors.As(err, &replayErr) || replayErr.Cell != 1 || replayErr.Exception == nil {
+		t.Fatalf("got %v, want the replay error of the second cell", err)
+	}
+	getReplayed(t, fake, pool, true, "a = 1", "raise")
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// dumpedBy returns the cells run by the kernel that wrote the snapshot a
+// kernel restored from, the fake kernels do not evaluate the helpers.
+func dumpedBy(t *testing.T, fake *kerneltest.Server, restored []string) []string {
+	t.Helper()
+	if len(restored) != 1 || !strings.Contains(restored[0], "load_session(") {
+		t.Fatalf("kernel ran %q, want a restored snapshot", restored)
+	}
+	path := restored[0][strings.Index(restored[0], "load_session(")+len("load_session(") : strings.Index(restored[0], ")")]
+	for _, candidate := range fake.Kernels() {
+		history := candidate.History()
+		var cells []string
+		for _, code := range history {
+			if strings.Contains(code, "dump_session("+path+")") {
+				return cells
+			}
+			if !strings.Contains(code, "__autopyter_") {
+				cells = append(cells, code)
+			}
+		}
+	}
+	t.Fatalf("no kernel wrote snapshot %s", path)
+	return nil
+}
+
+func TestPreloadedKernelsSnapshot(t *testing.T) {
+	fake, pool := newTestPoolConfig(t, PoolConfig{MinSize: 1, MaxSize: 3, Snapshot: true}, "a = 1")
+
+	for _, cells := range [][]string{{"a = 1"}, {"a = 1", "b = 2"}} {
+		if len(cells) > 1 {
+			if err := pool.Append(cells[len(cells)-1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		waitFor(t, "a warm kernel", func() bool { return pool.Stats().Ready > 0 })
+		kernel, err := pool.Get(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		history := fake.Kernel(kernel.ID).History()
+		if dumped := dumpedBy(t, fake, history); !reflect.DeepEqual(dumped, cells) {
+			t.Fatalf("restored a snapshot of %q, want %q", dumped, cells)
+		}
+		// the execution count continues after the cells
+		if count := fmt.Sprintf("execution_count = %d", len(cells)+1); !strings.Contains(history[0], count) {
+			t.Fatalf("restore %q does not set %s", history[0], count)
+		}
+		kernel.Close()
+	}
+}
+
+func TestPreloadedKernelsSnapshotBroken(t *testing.T) {
+	fake, pool := newTestPoolConfig(t, PoolConfig{MinSize: 1, MaxSize: 3, Snapshot: true}, "a = 1")
+	fake.Script("raise", kerneltest.Error("ValueError", "boom"))
+	waitFor(t, "a warm kernel", func() bool { return pool.Stats().Ready > 0 })
+
+	// the base fails, warm kernels must not restore the previous snapshot
+	if err := pool.Reset([]string{"b = 2", "raise"}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the replay error", func() bool { return pool.ReplayError() != nil })
+	waitFor(t, "the warm kernels", func() bool { return pool.Stats().Starting == 0 })
+	if pool.ReplayError() == nil {
+		t.Fatal("the replay error was cleared")
+	}
+	if _, err := pool.Get(false); err == nil {
+		t.Fatal("Get handed out a kernel of a broken checkpoint")
+	}
+}
+
+func TestPreloadedKernelsExecutionCount(t *testing.T) {
+	_, pool := newTestPool(t, "a = 1", "b = 2")
+	kernel, err := pool.Get(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kernel.Close()
+
+	// the replayed cells count, like in the notebook they came from
+	_, _, reply, err := kernel.ExecuteCode("c = 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.ExecutionCount != 3 {
+		t.Fatalf("got execution count %d, want 3", reply.ExecutionCount)
+	}
+}
@@ -0,0 +1,219 @@
+package kernel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+const DefaultServerName = "default"
+
+type Server struct {
+	Name string
+	// URL is the base URL of the Jupyter server, including the base path
+	// of e.g. a JupyterHub single-user server.
+	URL    *url.URL
+	Token  string
+	Header http.Header
+	client *http.Client
+	dialer *websocket.Dialer
+
+	password string
+	loginMu  sync.Mutex
+}
+
+type ServerOptions struct {
+	// CAFile is a PEM bundle of the CAs trusted in addition to the system
+	// ones.
+	CAFile             string
+	InsecureSkipVerify bool
+	// Header is added to every request, e.g. for reverse proxies.
+	Header http.Header
+	// Password logs in through the login form instead of using a token.
+	Password string
+}
+
+// NewServer creates a server from a URL such as "https://hub/user/me/", a
+// bare "host:port" is reached over plain http.
+func NewServer(name, rawURL, token string, options ServerOptions) (*Server, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	serverUrl, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if serverUrl.Scheme != "http" && serverUrl.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q in %s", serverUrl.Scheme, rawURL)
+	}
+	serverUrl.Path = "/" + strings.Trim(serverUrl.Path, "/")
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: options.InsecureSkipVerify}
+	if options.CAFile != "" {
+		pem, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", options.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig
+	dialer.Jar = jar
+
+	header := options.Header
+	if header == nil {
+		header = http.Header{}
+	}
+	return &Server{
+		Name:   name,
+		URL:    serverUrl,
+		Token:  token,
+		Header: header,
+		client: &http.Client{Transport: transport, Jar: jar},
+		dialer: &dialer,
+
+		password: options.Password,
+	}, nil
+}
+
+var (
+	servers   = map[string]*Server{}
+	serversMu sync.RWMutex
+)
+
+func RegisterServer(server *Server) error {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+
+	if server.Name == "" || strings.Contains(server.Name, "/") {
+		return fmt.Errorf("invalid server name: %q", server.Name)
+	}
+	if _, ok := servers[server.Name]; ok {
+		return fmt.Errorf("server %s is already registered", server.Name)
+	}
+	servers[server.Name] = server
+	return nil
+}
+
+func LookupServer(name string) (*Server, bool) {
+	serversMu.RLock()
+	defer serversMu.RUnlock()
+	server, ok := servers[name]
+	return server, ok
+}
+
+func DefaultServer() *Server {
+	server, _ := LookupServer(DefaultServerName)
+	return server
+}
+
+func (s *Server) header() http.Header {
+	header := s.Header.Clone()
+	if s.Token != "" {
+		header.Set("Authorization", "token "+s.Token)
+	}
+	if xsrf := s.cookie(xsrfCookie); xsrf != "" {
+		header.Set(xsrfHeader, xsrf)
+	}
+	return header
+}
+
+// endpoint returns the URL of an API path below the base URL of the server.
+func (s *Server) endpoint(elem ...string) *url.URL {
+	endpoint := *s.URL
+	endpoint.Path = path.Join(append([]string{s.URL.Path}, elem...)...)
+	return &endpoint
+}
+
+func (s *Server) websocketEndpoint(elem ...string) *url.URL {
+	endpoint := s.endpoint(elem...)
+	endpoint.Scheme = "ws"
+	if s.URL.Scheme == "https" {
+		endpoint.Scheme = "wss"
+	}
+	return endpoint
+}
+
+func (s *Server) do(method string, endpoint *url.URL, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, endpoint.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header = s.header()
+	resp, err := s.client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusForbidden || s.password == "" {
+		return resp, err
+	}
+
+	// The login session expired, log in again and retry once.
+	resp.Body.Close()
+	if err := s.Login(); err != nil {
+		return nil, err
+	}
+	retry, err := http.NewRequest(method, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+		retry.ContentLength = req.ContentLength
+	}
+	retry.Header = s.header()
+	return s.client.Do(retry)
+}
+
+// Target identifies a kernelspec on a Jupyter server.
+type Target struct {
+	Server *Server
+	Spec   string
+}
+
+// ParseTarget parses "spec" for the default server or "server/spec".
+func ParseTarget(value string) (Target, error) {
+	serverName, spec := DefaultServerName, value
+	if i := strings.Index(value, "/"); i >= 0 {
+		serverName, spec = value[:i], value[i+1:]
+	}
+	if spec == "" {
+		return Target{}, fmt.Errorf("missing kernelspec in target %q", value)
+	}
+	server, ok := LookupServer(serverName)
+	if !ok {
+		return Target{}, fmt.Errorf("unknown server %q in target %q", serverName, value)
+	}
+	return Target{Server: server, Spec: spec}, nil
+}
+
+func (t Target) String() string {
+	if t.Server == nil || t.Server.Name == DefaultServerName {
+		return t.Spec
+	}
+	return t.Server.Name + "/" + t.Spec
+}
@@ -0,0 +1,121 @@
+package kernel
+
+import (
+	"testing"
+
+	"github.com/hvaghani221/autopyter/internal/kernel/kerneltest"
+)
+
+func newTestServer(t *testing.T, token string, options kerneltest.Options) (*kerneltest.Server, *Server) {
+	t.Helper()
+	fake := kerneltest.NewServer(token, options)
+	t.Cleanup(fake.Close)
+
+	server, err := NewServer(t.Name(), fake.URL, token, ServerOptions{Password: options.Password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, server
+}
+
+func newTestKernel(t *testing.T, server *Server) *Kernel {
+	t.Helper()
+	kernel, err := server.CreateKernel(kerneltest.DefaultKernelSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(kernel.Close)
+	return kernel
+}
+
+func TestCreateKernelExecuteCode(t *testing.T) {
+	for _, basePath := range []string{"", "/user/me/"} {
+		t.Run("base path "+basePath, func(t *testing.T) {
+			fake, server := newTestServer(t, "secret", kerneltest.Options{BasePath: basePath})
+			fake.Script("print(1)", kerneltest.Stream("stdout", "1\n"))
+
+			kernel, err := server.CreateKernel(kerneltest.DefaultKernelSpec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results, exceptions, _, err := kernel.ExecuteCode("print(1)")
+			kernel.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(exceptions) != 0 {
+				t.Fatalf("unexpected exceptions: %v", exceptions)
+			}
+			if len(results) != 1 || results[0].Stream == nil || results[0].Stream.Text != "1\n" {
+				t.Fatalf("unexpected results: %+v", results)
+			}
+			if kernels := fake.Kernels(); len(kernels) != 0 {
+				t.Fatalf("%d kernels left after Close", len(kernels))
+			}
+		})
+	}
+}
+
+func TestExecuteCodeException(t *testing.T) {
+	fake, server := newTestServer(t, "secret", kerneltest.Options{})
+	fake.Script("1/0", kerneltest.Error("ZeroDivisionError", "division by zero"))
+
+	kernel := newTestKernel(t, server)
+	_, exceptions, _, err := kernel.ExecuteCode("1/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exceptions) != 1 || exceptions[0].EName != "ZeroDivisionError" {
+		t.Fatalf("unexpected exceptions: %+v", exceptions)
+	}
+}
+
+func TestWrongToken(t *testing.T) {
+	fake := kerneltest.NewServer("secret", kerneltest.Options{})
+	t.Cleanup(fake.Close)
+	server, err := NewServer(t.Name(), fake.URL, "wrong", ServerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := server.CreateKernel(kerneltest.DefaultKernelSpec); err == nil {
+		t.Fatal("CreateKernel succeeded with a wrong token")
+	}
+}
+
+func TestLogin(t *testing.T) {
+	fake, server := newTestServer(t, "", kerneltest.Options{BasePath: "/user/me", Password: "hunter2"})
+	fake.Script("x", kerneltest.ExecuteResult(map[string]any{"text/plain": "1"}))
+
+	// the first request is refused and logs in before it is retried
+	kernel := newTestKernel(t, server)
+	if logins := fake.Logins(); logins != 1 {
+		t.Fatalf("logged in %d times, want 1", logins)
+	}
+	results, _, _, err := kernel.ExecuteCode("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Data["text/plain"] != "1" {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+	if err := kernel.Interrupt(); err != nil {
+		t.Fatalf("interrupt without the XSRF header: %v", err)
+	}
+}
+
+func TestLoginWrongPassword(t *testing.T) {
+	fake := kerneltest.NewServer("", kerneltest.Options{Password: "hunter2"})
+	t.Cleanup(fake.Close)
+	server, err := NewServer(t.Name(), fake.URL, "", ServerOptions{Password: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.Login(); err == nil {
+		t.Fatal("Login succeeded with a wrong password")
+	}
+	if logins := fake.Logins(); logins != 0 {
+		t.Fatalf("logged in %d times, want 0", logins)
+	}
+}
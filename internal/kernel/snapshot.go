@@ -0,0 +1,62 @@
+package kernel
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// The snapshot helpers run in the user namespace, so they clean up the
+// names they introduce.
+const (
+	snapshotCode = `import dill as __autopyter_dill
+__autopyter_dill.dump_session(%s)
+del __autopyter_dill`
+	restoreCode = `import dill as __autopyter_dill
+__autopyter_dill.load_session(%s)
+del __autopyter_dill
+__import__("IPython").get_ipython().execution_count = %d`
+	removeSnapshotCode = `import os as __autopyter_os
+if __autopyter_os.path.exists(%[1]s):
+    __autopyter_os.remove(%[1]s)
+del __autopyter_os`
+)
+
+// Pickling a large namespace takes a while, removing a file does not.
+const (
+	snapshotTimeout       = 5 * time.Minute
+	removeSnapshotTimeout = 10 * time.Second
+)
+
+// Snapshot serialises the namespace of the kernel to path on the Jupyter
+// server, it fails when dill is missing or an object is not picklable.
+func (k *Kernel) Snapshot(path string) error {
+	return k.executeHelper(snapshotTimeout, fmt.Sprintf(snapshotCode, strconv.Quote(path)))
+}
+
+// Restore loads a namespace written by Snapshot into the kernel. The
+// snapshot does not include the execution count, so it is set to continue
+// after the cells that were executed before the snapshot.
+func (k *Kernel) Restore(path string, cells int) error {
+	return k.executeHelper(snapshotTimeout, fmt.Sprintf(restoreCode, strconv.Quote(path), cells+1))
+}
+
+func (k *Kernel) RemoveSnapshot(path string) error {
+	return k.executeHelper(removeSnapshotTimeout, fmt.Sprintf(removeSnapshotCode, strconv.Quote(path)))
+}
+
+// executeHelper runs code without storing it in the history, so that the
+// helpers do not count as executions.
+func (k *Kernel) executeHelper(timeout time.Duration, code string) error {
+	ctx, cancel := WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, exceptions, _, err := k.execute(ctx, code, nil, false)
+	if err != nil {
+		return err
+	}
+	if len(exceptions) > 0 {
+		return fmt.Errorf("%s: %s", exceptions[0].EName, exceptions[0].EValue)
+	}
+	return nil
+}
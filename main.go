@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/gorilla/mux"
@@ -25,17 +26,125 @@ var templateFs embed.FS
 func main() {
 	address := flag.String("address", "127.0.0.1:8080", "Address to listen on")
 	kernelAddr := flag.String("kernelhost", "127.0.0.1:8888", "kernel host address")
-	token := flag.String("token", "ab17a9eb56a95a0bb5af1befa3772368339592c3192da431", "API token")
+	kernelURL := flag.String("kernel-url", "", "Base URL of the Jupyter server, e.g. https://hub.example.com/user/me/ (overrides -kernelhost)")
+	caFile := flag.String("ca-file", "", "PEM bundle of additional CAs trusted for the Jupyter server")
+	insecure := flag.Bool("insecure", false, "Skip TLS certificate verification of the Jupyter server")
+	token := flag.String("token", "", "API token (default $"+kernel.TokenEnv+")")
+	tokenFile := flag.String("token-file", "", "File containing the API token")
+	passwordFile := flag.String("password-file", "", "File containing the Jupyter server password, used instead of a token (default $"+kernel.PasswordEnv+")")
 	debug := flag.Bool("debug", false, "Debug mode")
+	kernelSpec := flag.String("kernel", kernel.DefaultKernelSpec, "Name of the kernelspec to execute code with")
+	flag.DurationVar(&kernel.HeartbeatInterval, "heartbeat", kernel.HeartbeatInterval, "Liveness check interval of kernels, 0 disables it")
+	timeout := flag.Duration("timeout", 0, "Default execution timeout, 0 disables it")
+	session := flag.String("session", "", "Name of the session to persist, empty disables persistence")
+	sessionDir := flag.String("session-dir", "sessions", "Directory where sessions are stored")
+	resume := flag.Bool("resume", false, "Resume the session given by -session")
+	poolConfig := kernel.DefaultPoolConfig()
+	flag.IntVar(&poolConfig.MinSize, "pool-min", poolConfig.MinSize, "Number of warm kernels kept ready")
+	flag.IntVar(&poolConfig.MaxSize, "pool-max", poolConfig.MaxSize, "Maximum number of kernels a pool holds or starts, including its base kernel")
+	flag.DurationVar(&poolConfig.MaxIdle, "pool-max-idle", poolConfig.MaxIdle, "Replace warm kernels idle for longer, 0 disables it")
+	flag.DurationVar(&poolConfig.CheckInterval, "pool-check-interval", poolConfig.CheckInterval, "Health check interval of warm kernels, 0 disables it")
+	flag.BoolVar(&poolConfig.Snapshot, "snapshot", poolConfig.Snapshot, "Start warm kernels from a dill snapshot of the selected state instead of replaying it")
+	var servers, compare, headers listFlag
+	flag.Var(&servers, "server", "Additional Jupyter server as name=url, can be repeated")
+	flag.Var(&headers, "header", "Extra header sent to Jupyter servers as \"Name: value\", can be repeated")
+	flag.Var(&compare, "compare", "Target of \"Execute on all\" as kernelspec or server/kernelspec, can be repeated (default every kernelspec)")
+	importFile := flag.String("import", "", "Notebook (.ipynb) or script (.py) to use as the starting state")
 
 	flag.Parse()
-	kernel.InitKernel(*kernelAddr, *token, *debug)
+	apiToken, err := kernel.ReadCredential(*token, *tokenFile, kernel.TokenEnv)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	password, err := kernel.ReadCredential("", *passwordFile, kernel.PasswordEnv)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	serverOptions := kernel.ServerOptions{
+		CAFile:             *caFile,
+		InsecureSkipVerify: *insecure,
+		Header:             http.Header{},
+		Password:           password,
+	}
+	for _, header := range headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			log.Fatalf("error: invalid header %q, expected \"Name: value\"", header)
+		}
+		serverOptions.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if *kernelURL == "" {
+		*kernelURL = *kernelAddr
+	}
+	defaultServer, err := kernel.NewServer(kernel.DefaultServerName, *kernelURL, apiToken, serverOptions)
+	if err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if err := kernel.InitKernel(defaultServer, *debug); err != nil {
+		log.Fatalf("error: %v", err)
+	}
+	if password != "" {
+		if err := defaultServer.Login(); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+	}
+	for _, server := range servers {
+		name, serverURL, ok := strings.Cut(server, "=")
+		if !ok {
+			log.Fatalf("error: invalid server %q, expected name=url", server)
+		}
+		extraServer, err := kernel.NewServer(name, serverURL, apiToken, serverOptions)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		if err := kernel.RegisterServer(extraServer); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		if password != "" {
+			if err := extraServer.Login(); err != nil {
+				log.Fatalf("error: %v", err)
+			}
+		}
+	}
+	var compareTargets []kernel.Target
+	for _, value := range compare {
+		target, err := kernel.ParseTarget(value)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		compareTargets = append(compareTargets, target)
+	}
 
 	r := mux.NewRouter()
 
-	c := code.NewCode(templateFs, *debug)
+	options := code.Options{
+		Debug:      *debug,
+		Timeout:    *timeout,
+		Pool:       poolConfig,
+		KernelSpec: *kernelSpec,
+		Compare:    compareTargets,
+		Session:    *session,
+		Resume:     *resume,
+	}
+	if *session != "" {
+		store, err := code.NewFileStore(*sessionDir)
+		if err != nil {
+			log.Fatalf("error: %v", err)
+		}
+		options.Store = store
+	} else if *resume {
+		log.Fatal("error: -resume requires -session")
+	}
+
+	c := code.NewCode(templateFs, options)
 	defer c.Close()
+	if *importFile != "" {
+		if err := c.Import(*importFile); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+	}
 	r.HandleFunc("/", c.PageHandler)
+	r.Methods("GET").Path("/page/events").HandlerFunc(c.EventsHandler)
 	r.Methods("GET").Path("/page/clip").HandlerFunc(c.ClipHandler)
 	r.Methods("DELETE").Path("/page/clip/{ID}").HandlerFunc(c.ClipDeleteHandler)
 
@@ -43,18 +152,33 @@ func main() {
 	r.Methods("DELETE").Path("/page/code/{ID}").HandlerFunc(c.CodeDeleteHandler)
 
 	r.Methods("POST").Path("/page/execute/{ID}").HandlerFunc(c.ExecuteHandler)
+	r.Methods("POST").Path("/page/cancel/{ID}").HandlerFunc(c.CancelHandler)
+	r.Methods("POST").Path("/page/input/{ID}").HandlerFunc(c.InputHandler)
+	r.Methods("POST").Path("/page/executeall/{ID}").HandlerFunc(c.ExecuteAllHandler)
+	r.Methods("GET").Path("/page/compare/{ID}").HandlerFunc(c.CompareHandler)
 
 	r.Methods("GET").Path("/page/result/{ID}").HandlerFunc(c.ResultHandler)
+	r.Methods("GET").Path("/page/result/{ID}/stream").HandlerFunc(c.ResultStreamHandler)
 
 	r.Methods("GET").Path("/page/select/{ID}").HandlerFunc(c.SelectHandler)
+	r.Methods("GET").Path("/page/checkout/{ID}").HandlerFunc(c.CheckoutHandler)
 
 	r.Methods("GET").Path("/page/state").HandlerFunc(c.StateHander)
 	r.Methods("GET").Path("/page/reset").HandlerFunc(c.StateResetHander)
 	r.Methods("DELETE").Path("/page/state/{ID}").HandlerFunc(c.StateDeleteHander)
+	r.Methods("POST").Path("/page/state/allowbroken").HandlerFunc(c.AllowBrokenHandler)
+
+	r.Methods("GET").Path("/page/kernelspec").HandlerFunc(c.KernelSpecHandler)
+	r.Methods("POST").Path("/page/kernelspec").HandlerFunc(c.KernelSpecSelectHandler)
 
 	r.Methods("GET").Path("/page/editor").HandlerFunc(c.EditorHandler)
 	r.Methods("POST").Path("/page/editor/execute").HandlerFunc(c.EditorExecuteHandler)
 
+	r.Methods("GET").Path("/export/notebook").HandlerFunc(c.ExportNotebookHandler)
+	r.Methods("GET").Path("/export/script").HandlerFunc(c.ExportScriptHandler)
+	r.Methods("POST").Path("/page/import").HandlerFunc(c.ImportHandler)
+	r.Methods("GET").Path("/api/status").HandlerFunc(c.StatusHandler)
+
 	// Static files
 	r.PathPrefix("/static/").Handler(http.FileServer(http.FS(staticFiles)))
 
@@ -79,6 +203,17 @@ func main() {
 	}
 }
 
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 // func dynamicFileServer(fs fs.FS) http.Handler {
 // 	return http.FileServer(http.FS(fs))
 // }